@@ -4,11 +4,14 @@ import (
 	"context"
 	"math"
 	"math/rand"
+	"sync"
 	"time"
 )
 
 type (
 	Backoff struct {
+		// generator is shared by concurrent Wait calls
+		m             sync.Mutex
 		generator     *rand.Rand
 		jitter        float64
 		multiplier    float64
@@ -73,27 +76,39 @@ func (b *Backoff) Wait(ctx context.Context, retry uint) chan struct{} {
 		close(ch)
 		return ch
 	}
-	jitter := b.genJitterMultiplier()
-	delay := math.Pow(2, float64(retry-1))
-	delay = delay * jitter
-	delay = math.Min(delay, b.maxDelay*jitter)
+	delay := b.Duration(retry)
 	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
 		select {
 		case <-ctx.Done():
-			return
-		case <-time.After(time.Duration(delay) * time.Millisecond):
-			close(ch)
+		case <-timer.C:
 		}
+		close(ch)
 	}()
 
 	return ch
 }
 
+// Duration - returns delay Wait would use for specified retry number
+func (b *Backoff) Duration(retry uint) time.Duration {
+	if retry == 0 {
+		return 0
+	}
+	jitter := b.genJitterMultiplier()
+	delay := math.Pow(2, float64(retry-1))
+	delay = delay * jitter
+	delay = math.Min(delay, b.maxDelay*jitter)
+	return time.Duration(delay) * time.Millisecond
+}
+
 // Once - generates duration with default value and jitter
 func (b *Backoff) Once(ctx context.Context) chan struct{} {
 	return b.Wait(ctx, 1)
 }
 
 func (b *Backoff) genJitterMultiplier() float64 {
+	b.m.Lock()
+	defer b.m.Unlock()
 	return 1 + b.jitter - (b.generator.Float64() * 2 * b.jitter)
 }
@@ -1,11 +1,17 @@
 module github.com/hop-city/common
 
-go 1.12
+go 1.17
 
 require (
 	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/jessevdk/go-flags v1.4.0
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
 	github.com/rs/zerolog v1.14.3
 	github.com/stretchr/testify v1.3.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 )
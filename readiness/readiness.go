@@ -12,6 +12,9 @@ type (
 	}
 )
 
+// ShuttingDown - key set to not ready when http server starts draining connections
+const ShuttingDown = "shutting down"
+
 var data = status{ready: make(map[string]bool)}
 var logg = logger.New()
 
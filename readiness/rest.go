@@ -4,12 +4,27 @@ import (
 	"context"
 	"github.com/go-chi/chi"
 	"github.com/rs/zerolog"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 )
 
+type (
+	ServerOptions struct {
+		Port string
+		// already bound listener, e.g. port 0 - Port is ignored if set
+		Listener net.Listener
+		// time given to in-flight requests on shutdown - 30s by default
+		DrainTimeout time.Duration
+		// time between flipping readiness and draining, lets load balancer
+		// see the instance as not ready. 0 by default, as without load balancer
+		// there is nothing to wait for - behind one set it to its probe period
+		PreStopDelay time.Duration
+	}
+)
+
 func Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var err error
@@ -64,45 +79,85 @@ func Attach(ctx context.Context, r chi.Router) {
 	}))
 }
 
-func StartServer(ctx context.Context, port string) {
+// StartServer - starts health check server with default shutdown options, see Serve
+func StartServer(ctx context.Context, port string) <-chan error {
+	return Serve(ctx, ServerOptions{Port: port})
+}
+
+// Serve - starts health check server in background. When ctx is done readiness
+// flips to not ready, server waits PreStopDelay and drains connections.
+// Listener is bound before Serve returns. Returned channel is closed once server
+// is stopped, error is sent first if server failed to listen or to drain connections.
+func Serve(ctx context.Context, opt ServerOptions) <-chan error {
 	logg = zerolog.Ctx(ctx)
 	r := chi.NewRouter()
 
 	Attach(ctx, r)
 
-	if port == "" {
-		port = os.Getenv("PORT")
+	done := make(chan error, 1)
+	listener := opt.Listener
+	if listener == nil {
+		port := opt.Port
+		if port == "" {
+			port = os.Getenv("PORT")
+		}
+		if port == "" {
+			port = "8080"
+		}
+		var err error
+		listener, err = net.Listen("tcp", ":"+port)
+		if err != nil {
+			logg.Error().Err(err).Msg("Readiness.StartServer: Error starting health check server")
+			done <- err
+			close(done)
+			return done
+		}
 	}
-	if port == "" {
-		port = "8080"
+	if opt.DrainTimeout == 0 {
+		opt.DrainTimeout = 30 * time.Second
 	}
 
 	server := http.Server{
-		Addr:              ":" + port,
 		Handler:           r,
 		ReadHeaderTimeout: 30 * time.Second,
 		WriteTimeout:      30 * time.Second,
 		IdleTimeout:       120 * time.Second,
 	}
 
-	logg.Info().Msg("Readiness.StartServer: starting listening on port 8080")
+	logg.Info().Msgf("Readiness.StartServer: listening on %s", listener.Addr())
+	// previous server could leave readiness flipped
+	Set(ShuttingDown, true)
+	serveErr := make(chan error, 1)
 	go func() {
-		err := server.ListenAndServe()
-		if err != nil {
-			// skip error on normal close
-			if !strings.Contains(err.Error(), "Server closed") {
-				logg.Error().Err(err).Msg("Readiness.StartServer: Error starting health check server")
-			}
-		}
+		serveErr <- server.Serve(listener)
 	}()
 
 	// stop server
 	go func() {
-		<-ctx.Done()
-		err := server.Close()
+		defer close(done)
+		select {
+		case err := <-serveErr:
+			logg.Error().Err(err).Msg("Readiness.StartServer: health check server stopped unexpectedly")
+			done <- err
+			return
+		case <-ctx.Done():
+		}
+
+		Set(ShuttingDown, false)
+		if opt.PreStopDelay > 0 {
+			logg.Info().Msgf("Readiness.StartServer: waiting %s before shutdown", opt.PreStopDelay)
+			time.Sleep(opt.PreStopDelay)
+		}
+		drainCtx, cancel := context.WithTimeout(context.Background(), opt.DrainTimeout)
+		defer cancel()
+		err := server.Shutdown(drainCtx)
 		if err != nil {
-			logg.Error().Err(err).Msg("Readiness.StartServer: error stopping health check server")
+			logg.Error().Err(err).Msg("Readiness.StartServer: error draining health check server, closing")
+			_ = server.Close()
+			done <- err
+			return
 		}
 		logg.Info().Msg("Readiness.StartServer: health check server shut down")
 	}()
+	return done
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -82,10 +83,17 @@ func TestMiddleware(t *testing.T) {
 	cancel()
 }
 
+func listen(t *testing.T) (net.Listener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "Should be able to bind random port")
+	return l, "http://" + l.Addr().String()
+}
+
 func TestStartServer_liveness(t *testing.T) {
 	ctx, cancel := setup()
-	StartServer(ctx, "")
-	resp, err := http.Get("http://localhost:8080/liveness")
+	l, url := listen(t)
+	done := Serve(ctx, ServerOptions{Listener: l})
+	resp, err := http.Get(url + "/liveness")
 	assert.Nil(t, err, "Server should start")
 	if resp != nil {
 		assert.Equal(t,
@@ -95,11 +103,13 @@ func TestStartServer_liveness(t *testing.T) {
 			"Incorrect body, 'OK' expected")
 	}
 	cancel()
+	<-done
 }
 func TestStartServer_readiness(t *testing.T) {
 	ctx, cancel := setup()
-	StartServer(ctx, "")
-	resp, err := http.Get("http://localhost:8080/readiness")
+	l, url := listen(t)
+	done := Serve(ctx, ServerOptions{Listener: l})
+	resp, err := http.Get(url + "/readiness")
 	assert.Nil(t, err, "Server should start")
 	if resp != nil {
 		assert.Equal(t,
@@ -109,7 +119,7 @@ func TestStartServer_readiness(t *testing.T) {
 			"Incorrect body, 'OK' expected")
 	}
 	Set("a", false)
-	resp, err = http.Get("http://localhost:8080/readiness")
+	resp, err = http.Get(url + "/readiness")
 	assert.Nil(t, err, "Should be able to connect")
 
 	if resp != nil {
@@ -122,7 +132,7 @@ func TestStartServer_readiness(t *testing.T) {
 	Set("b", false)
 	Set("a", true)
 	Set("b", true)
-	resp, err = http.Get("http://localhost:8080/readiness")
+	resp, err = http.Get(url + "/readiness")
 	assert.Nil(t, err, "Should be able to connect")
 	if resp != nil {
 		assert.Equal(t,
@@ -132,4 +142,42 @@ func TestStartServer_readiness(t *testing.T) {
 			"Incorrect body, 'OK' expected")
 	}
 	cancel()
+	<-done
+}
+
+func TestStartServer_error(t *testing.T) {
+	ctx, cancel := setup()
+	defer cancel()
+	l, _ := listen(t)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	assert.NotNil(t, <-StartServer(ctx, port), "Bind error should be returned")
+}
+
+func TestServe_shutdown(t *testing.T) {
+	ctx, cancel := setup()
+	l, url := listen(t)
+	done := Serve(ctx, ServerOptions{Listener: l, PreStopDelay: 100 * time.Millisecond})
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+
+	resp, err := http.Get(url + "/readiness")
+	assert.Nil(t, err, "Server should keep serving during pre-stop delay")
+	if resp != nil {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode,
+			"Readiness should return 503 while shutting down")
+		_ = resp.Body.Close()
+	}
+	assert.Nil(t, <-done, "Server should shut down cleanly")
+	_, err = http.Get(url + "/readiness")
+	assert.NotNil(t, err, "Server should be stopped")
+
+	assert.False(t, IsReady(), "Readiness should stay flipped after shutdown")
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	l, _ = listen(t)
+	done = Serve(ctx, ServerOptions{Listener: l})
+	assert.True(t, IsReady(), "Readiness should be reset when server starts again")
+	cancel()
+	<-done
 }
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// assertions are used once, short lifetime is enough
+var assertionLifetime = 5 * time.Minute
+
+// Loads PEM encoded private key from string or, if it's empty, from file.
+// Supports PKCS#8, PKCS#1 RSA and SEC1 EC keys.
+func loadPrivateKey(key crypto.Signer, pemKey string, file string) (crypto.Signer, error) {
+	if key != nil {
+		return key, nil
+	}
+	data := []byte(pemKey)
+	if pemKey == "" {
+		if file == "" {
+			return nil, errors.New("missing private key")
+		}
+		var err error
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading private key file")
+		}
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := k.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.Errorf("unsupported private key type %T", k)
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
+
+// Picks signing algorithm matching the key
+func signingAlg(key crypto.Signer) (string, error) {
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return "ES256", nil
+		case 384:
+			return "ES384", nil
+		case 521:
+			return "ES512", nil
+		}
+	}
+	return "", errors.Errorf("unsupported key type %T", key.Public())
+}
+
+// Creates signed assertion for auth server (RFC 7523)
+func (a *Auth) assertion(issuer, subject string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	audience := a.audience
+	if audience == "" {
+		audience = a.url
+	}
+	now := time.Now()
+	claims := Claims{
+		"iss": issuer,
+		"sub": subject,
+		"aud": audience,
+		"iat": now.Unix(),
+		"exp": now.Add(assertionLifetime).Unix(),
+		"jti": hex.EncodeToString(jti),
+	}
+	return signJWT(a.alg, a.keyID, a.key, claims)
+}
+
+// Adds client authentication to token request
+func (a *Auth) authenticateClient(query url.Values, header http.Header, creds Credentials) error {
+	switch a.clientAuth {
+	case ClientAuthPrivateKeyJWT:
+		assertion, err := a.assertion(creds.ClientID, creds.ClientID)
+		if err != nil {
+			return errors.Wrap(err, "error signing client assertion")
+		}
+		query.Set("client_id", creds.ClientID)
+		query.Set("client_assertion_type", clientAssertionType)
+		query.Set("client_assertion", assertion)
+	default:
+		authenticateWithSecret(a.clientAuth, creds.ClientID, creds.Secret, query, header)
+	}
+	return nil
+}
+
+// Adds client_secret_basic, client_secret_post or none client authentication
+func authenticateWithSecret(method, clientID, secret string, query url.Values, header http.Header) {
+	switch method {
+	case ClientAuthPost:
+		query.Set("client_id", clientID)
+		query.Set("client_secret", secret)
+	case ClientAuthNone:
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+	default:
+		credentials := []byte(clientID + ":" + secret)
+		encoded := base64.StdEncoding.EncodeToString(credentials)
+		header.Set("authorization", "Basic "+encoded)
+	}
+}
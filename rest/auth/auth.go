@@ -3,12 +3,12 @@ package auth
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto"
 	"encoding/json"
 	"github.com/hop-city/common/backoff"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -28,19 +28,42 @@ type (
 		tokens *tokenResponse
 
 		m             sync.RWMutex
-		tokenRequests []chan string
+		tokenRequests []chan tokenResult
 		valid         *atomic.Value
 		fetching      *atomic.Value
 		reqCount      uint
 
-		username string
-		password string
-		clientID string
-		secret   string
-		scope    string
+		// guarded by m - can be reloaded from source
+		creds  Credentials
+		source CredentialSource
+		scope  string
+
+		// client authentication method and assertion signing
+		clientAuth string
+		key        crypto.Signer
+		keyID      string
+		alg        string
+		issuer     string
+		subject    string
+		audience   string
 
 		retryMultiplier float64
 		maxRetries      uint
+
+		renewBefore time.Duration
+		// guarded by m
+		renewTimer    *time.Timer
+		expiryTimer   *time.Timer
+		expiresAt     time.Time
+		renewFailures uint
+
+		registry *Registry
+
+		// events
+		hook         func(Event)
+		chainStart   time.Time
+		attemptStart time.Time
+		attemptGrant string
 	}
 
 	tokenResponse struct {
@@ -49,17 +72,34 @@ type (
 		TokenType    string `json:"token_type"`
 		Scope        string `json:"scope"`
 		RefreshToken string `json:"refresh_token"`
+
+		// token exchange only
+		IssuedTokenType string `json:"issued_token_type"`
+	}
+
+	tokenResult struct {
+		token string
+		err   error
 	}
 )
 
+var (
+	// ErrInvalidCredentials - auth server rejected provided credentials
+	ErrInvalidCredentials = errors.New("rest/auth: invalid credentials")
+	// ErrUnreachable - auth server could not be reached or failed to respond
+	ErrUnreachable = errors.New("rest/auth: auth server unreachable")
+	// ErrMalformedResponse - auth server response could not be read
+	ErrMalformedResponse = errors.New("rest/auth: malformed token response")
+)
+
 var maxRetries = uint(3)
-var authList = make([]*Auth, 0)
-var readyCallbacks = make([]func(bool), 0)
-var oldReady = false
+var renewBefore = 30 * time.Second
+
+// first delay before failed background renewal is retried, doubled on every failure
+var renewRetry = 5 * time.Second
 
 var retryWait *backoff.Backoff
 
-// TODO(mb) support refresh
 // TODO(mb) add other authorisation methods as needed
 
 func init() {
@@ -70,19 +110,23 @@ func init() {
 func authBase() *Auth {
 	a := Auth{
 		url:             os.Getenv("AUTH_URL"),
-		tokenRequests:   make([]chan string, 0),
+		tokenRequests:   make([]chan tokenResult, 0),
 		valid:           &atomic.Value{},
 		fetching:        &atomic.Value{},
 		retryMultiplier: 1,
 		tokens:          &tokenResponse{},
 		maxRetries:      maxRetries,
 		reqCount:        0,
+		renewBefore:     renewBefore,
 	}
 	a.valid.Store(false)
 	a.fetching.Store(false)
-	authList = append(authList, &a)
+	a.client = httpClient()
+	return &a
+}
 
-	// timeout
+// http client with timeout set from AUTH_TIMEOUT (in mills)
+func httpClient() *http.Client {
 	to := 5000
 	toS := os.Getenv("AUTH_TIMEOUT")
 	if len(toS) > 0 {
@@ -91,12 +135,9 @@ func authBase() *Auth {
 			to = t
 		}
 	}
-	a.client = &http.Client{
+	return &http.Client{
 		Timeout: time.Millisecond * time.Duration(to),
 	}
-
-	notifyReadyChange()
-	return &a
 }
 
 func (a *Auth) setValid(newState bool) {
@@ -104,46 +145,69 @@ func (a *Auth) setValid(newState bool) {
 	current := a.valid.Load().(bool)
 	if current != newState {
 		a.valid.Store(newState)
-		notifyReadyChange()
-	}
-}
-func notifyReadyChange() {
-	newReady := globalReadyStatus()
-	if oldReady != newReady {
-		oldReady = newReady
-		for _, callback := range readyCallbacks {
-			callback(newReady)
+		a.m.RLock()
+		registry := a.registry
+		a.m.RUnlock()
+		if registry != nil {
+			registry.notify()
 		}
 	}
 }
 
-func globalReadyStatus() bool {
-	globalReady := true
-	for _, auth := range authList {
-		globalReady = globalReady && auth.valid.Load().(bool)
+// Adds auth to registry (default one if nil) and removes it from its registry when ctx is closed
+func (a *Auth) register(registry *Registry) *Auth {
+	if registry == nil {
+		registry = DefaultRegistry()
+	}
+	registry.Register(a)
+	if a.source != nil {
+		go a.watchCredentials()
 	}
-	return globalReady
+	go func() {
+		<-a.ctx.Done()
+		a.m.RLock()
+		registry := a.registry
+		a.m.RUnlock()
+		if registry != nil {
+			registry.Unregister(a)
+		}
+	}()
+	return a
 }
 
 // Fans out tokens to awaiting parties (subscribed)
 // Requests to fetch if token is not valid
 func (a *Auth) distributeTokens() {
 	if !a.valid.Load().(bool) {
-		// TODO(mb) support refresh
 		a.fetchToken()
 		return
 	}
 	a.m.Lock()
 	defer a.m.Unlock()
 	for _, c := range a.tokenRequests {
-		c <- a.tokens.AccessToken
+		c <- tokenResult{token: a.tokens.AccessToken}
 	}
-	a.tokenRequests = make([]chan string, 0)
+	a.tokenRequests = make([]chan tokenResult, 0)
 }
 
+// Starts fetching chain unless one is already in progress.
+// reqCount is only used by goroutine that started the chain.
 func (a *Auth) fetchToken() {
+	a.m.Lock()
+	if a.fetching.Load().(bool) {
+		a.m.Unlock()
+		return
+	}
+	a.fetching.Store(true)
+	a.reqCount = 0
+	a.m.Unlock()
+	a.attempt()
+}
+
+// Single attempt of fetching chain, waits with backoff before retries
+func (a *Auth) attempt() {
 	//if a.typ == TypeClientCredentials {
-	//	credentials := []byte(a.clientID + ":" + a.secret)
+	//	credentials := []byte(a.creds.ClientID + ":" + a.creds.Secret)
 	//	encoded := base64.StdEncoding.EncodeToString(credentials)
 	//	authHeader := "Basic " + encoded
 	//	a.tokens.AccessToken = authHeader
@@ -155,121 +219,287 @@ func (a *Auth) fetchToken() {
 	//}
 
 	a.reqCount++
-
-	// disallow fetch retry chain start if already in process
-	if a.reqCount == 1 && a.fetching.Load().(bool) {
+	select {
+	case <-a.ctx.Done():
+		a.fetching.Store(false)
 		return
-	} else {
-		select {
-		case <-a.ctx.Done():
-			return
-		case <-retryWait.Wait(a.ctx, a.reqCount-1):
-		}
+	case <-retryWait.Wait(a.ctx, a.reqCount-1):
 	}
-	a.fetching.Store(true)
 
-	// Query -> buffer
-	query := url.Values{}
-	if a.scope != "" {
-		query.Add("scope", a.scope)
+	// refresh token is preferred over original grant if present,
+	// renewal timer and Token callers share tokens, so snapshot is used
+	a.m.RLock()
+	refreshToken := a.tokens.RefreshToken
+	a.m.RUnlock()
+	grant := a.typ
+	if refreshToken != "" {
+		grant = TypeRefreshToken
 	}
-	query.Add("grant_type", a.typ)
-	if a.typ == TypeResourceOwner {
-		query.Add("username", a.username)
-		query.Add("password", a.password)
+	creds := a.credentials()
+	a.attemptStart = time.Now()
+	a.attemptGrant = grant
+	if a.reqCount == 1 {
+		a.chainStart = a.attemptStart
+		a.emit(Event{Type: EventRefreshStarted, Grant: grant, Attempt: 1})
 	}
-	body := bytes.NewBuffer([]byte(query.Encode()))
 
-	req, err := http.NewRequest("POST", a.url, body)
-	if err != nil {
-		return
+	resp, err := a.requestToken(grant, creds, refreshToken)
+	if err == nil && grant == TypeRefreshToken && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		// refresh token expired or was revoked - fall back to original grant
+		_ = resp.Body.Close()
+		zerolog.Ctx(a.ctx).Debug().
+			Str("clientId", creds.ClientID).
+			Int("code", resp.StatusCode).
+			Msg("Auth.fetchToken: refresh token rejected, falling back to original grant")
+		a.m.Lock()
+		if a.tokens.RefreshToken == refreshToken {
+			a.tokens.RefreshToken = ""
+		}
+		a.m.Unlock()
+		grant = a.typ
+		a.attemptGrant = grant
+		resp, err = a.requestToken(grant, creds, "")
 	}
-	// headers
-
-	credentials := []byte(a.clientID + ":" + a.secret)
-	encoded := base64.StdEncoding.EncodeToString(credentials)
-	authHeader := "Basic " + encoded
-	req.Header.Set("authorization", authHeader)
-	req.Header.Set("content-type", "application/x-www-form-urlencoded")
-
-	resp, err := a.client.Do(req)
 	// the definition of madness is to try the same thing
 	// multiple times hoping for different result
 	if err != nil {
-		if a.reqCount <= a.maxRetries {
-			a.fetchToken()
-			return
-		}
-		err = errors.Wrapf(
-			err,
-			"Auth.fetchToken: Connection error, can not authorise user '%s' with method '%s'. Blocked!",
-			a.username,
+		a.retry(errors.Wrapf(
+			ErrUnreachable,
+			"Auth.fetchToken: Connection error, can not authorise user '%s' with method '%s': %s",
+			creds.Username,
 			a.typ,
-		)
-		log.SetOutput(os.Stderr)
-		log.Println(err)
-		log.SetOutput(os.Stdout)
+			err,
+		))
 		return
 	}
+	defer resp.Body.Close()
+
 	// if 4xx most probably we do something wrong and it doesn't make sense to retry
 	// die :( - if readiness is hooked to auth state changes, pod will probably be restarted
 	if resp.StatusCode%400 < 100 {
-		if a.reqCount <= a.maxRetries {
-			a.fetchToken()
-			return
+		// rotated secret - reread credentials before retrying
+		if a.source != nil && oauthError(resp) == "invalid_client" {
+			a.reloadCredentials()
 		}
-		log.SetOutput(os.Stderr)
-		log.Printf(
-			"Auth.fetchToken: problem with request to authorise user '%s' with method '%s'. Code: %d. Blocked!",
-			a.username,
+		a.retry(errors.Wrapf(
+			ErrInvalidCredentials,
+			"Auth.fetchToken: problem with request to authorise user '%s' with method '%s'. Code: %d",
+			creds.Username,
 			a.typ,
 			resp.StatusCode,
-		)
-		log.SetOutput(os.Stdout)
+		))
 		return
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		a.fetchToken()
+		a.retry(errors.Wrapf(
+			ErrUnreachable,
+			"Auth.fetchToken: auth server error for user '%s' with method '%s'. Code: %d",
+			creds.Username,
+			a.typ,
+			resp.StatusCode,
+		))
 		return
 	}
 	// 200
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		err = errors.Wrapf(
-			err,
-			"Auth.fetchToken: error reading body for user '%s' with method '%s'",
-			a.username,
+		a.retry(errors.Wrapf(
+			ErrMalformedResponse,
+			"Auth.fetchToken: error reading body for user '%s' with method '%s': %s",
+			creds.Username,
 			a.typ,
-		)
-		log.SetOutput(os.Stderr)
-		log.Println(err)
-		log.SetOutput(os.Stdout)
-		a.fetchToken()
+			err,
+		))
 		return
 	}
 
 	tokens := &tokenResponse{}
 	err = json.Unmarshal(respBody, tokens)
+	if err == nil && tokens.AccessToken == "" {
+		err = errors.New("missing access_token")
+	}
 	if err != nil {
-		err = errors.Wrapf(
-			err,
-			"Auth.fetchToken: error unmarshalling body for user '%s' with method '%s'",
-			a.username,
+		a.retry(errors.Wrapf(
+			ErrMalformedResponse,
+			"Auth.fetchToken: error unmarshalling body for user '%s' with method '%s': %s",
+			creds.Username,
 			a.typ,
-		)
-		log.SetOutput(os.Stderr)
-		log.Println(err)
-		log.SetOutput(os.Stdout)
-		a.fetchToken()
+			err,
+		))
 		return
 	}
 
+	// refresh response doesn't have to contain new refresh token
+	if grant == TypeRefreshToken && tokens.RefreshToken == "" {
+		tokens.RefreshToken = refreshToken
+	}
+
+	a.m.Lock()
 	a.tokens = tokens
+	a.renewFailures = 0
+	a.m.Unlock()
+
+	duration := time.Since(a.chainStart)
+	zerolog.Ctx(a.ctx).Debug().
+		Str("clientId", creds.ClientID).
+		Str("grant", grant).
+		Uint("attempt", a.reqCount).
+		Dur("duration", duration).
+		Msg("Auth.fetchToken: token acquired")
+	a.emit(Event{Type: EventTokenAcquired, Grant: grant, Attempt: a.reqCount, Duration: duration})
 	a.reqCount = 0
 	a.fetching.Store(false)
 	a.setValid(true)
+	a.scheduleRenewal(tokens.ExpiresIn)
 	a.distributeTokens()
 }
 
-//req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+// Retries token fetch or gives up if retries limit is reached
+func (a *Auth) retry(err error) {
+	if a.reqCount <= a.maxRetries {
+		duration := time.Since(a.attemptStart)
+		zerolog.Ctx(a.ctx).Debug().Err(err).
+			Str("clientId", a.credentials().ClientID).
+			Str("grant", a.attemptGrant).
+			Uint("attempt", a.reqCount).
+			Dur("duration", duration).
+			Msg("Auth.fetchToken: retrying")
+		a.emit(Event{Type: EventRetry, Grant: a.attemptGrant, Attempt: a.reqCount, Duration: duration, Err: err})
+		a.attempt()
+		return
+	}
+	a.giveUp(err)
+}
+
+// Stops fetching and returns error to all awaiting parties.
+// Next token request will start new fetching chain. If current token
+// is still valid, background renewal is retried with backoff.
+func (a *Auth) giveUp(err error) {
+	duration := time.Since(a.chainStart)
+	zerolog.Ctx(a.ctx).Error().Err(err).
+		Str("clientId", a.credentials().ClientID).
+		Str("grant", a.attemptGrant).
+		Uint("attempt", a.reqCount).
+		Dur("duration", duration).
+		Msg("Auth.fetchToken: giving up, token not acquired")
+	a.emit(Event{Type: EventGivenUp, Grant: a.attemptGrant, Attempt: a.reqCount, Duration: duration, Err: err})
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.reqCount = 0
+	a.fetching.Store(false)
+	for _, c := range a.tokenRequests {
+		c <- tokenResult{err: err}
+	}
+	a.tokenRequests = make([]chan tokenResult, 0)
+	a.retryRenewal()
+}
+
+// Schedules background token renewal before token expires,
+// so Token doesn't have to wait for a new one, and invalidates
+// token once it expires. Timers are stopped when auth context is closed.
+func (a *Auth) scheduleRenewal(expiresIn int) {
+	if expiresIn <= 0 {
+		return
+	}
+	lifetime := time.Duration(expiresIn) * time.Second
+	delay := lifetime - a.renewBefore
+	if delay <= 0 {
+		delay = lifetime / 2
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.renewTimer == nil {
+		go func() {
+			<-a.ctx.Done()
+			a.m.Lock()
+			a.renewTimer.Stop()
+			a.expiryTimer.Stop()
+			a.m.Unlock()
+		}()
+	} else {
+		a.renewTimer.Stop()
+		a.expiryTimer.Stop()
+	}
+	a.expiresAt = time.Now().Add(lifetime)
+	a.renewTimer = time.AfterFunc(delay, a.renew)
+	a.expiryTimer = time.AfterFunc(lifetime, a.expire)
+}
+
+// Reschedules failed renewal while token is still valid, has to be called with m locked
+func (a *Auth) retryRenewal() {
+	left := time.Until(a.expiresAt)
+	if a.renewTimer == nil || a.ctx.Err() != nil || left <= 0 {
+		return
+	}
+	a.renewFailures++
+	delay := renewRetry
+	for i := uint(1); i < a.renewFailures && delay < left; i++ {
+		delay *= 2
+	}
+	// keep trying before token expires
+	if delay > left/2 {
+		delay = left / 2
+	}
+	a.renewTimer.Stop()
+	a.renewTimer = time.AfterFunc(delay, a.renew)
+}
+
+// Fetches new token while current one is still valid
+func (a *Auth) renew() {
+	if a.ctx.Err() != nil {
+		return
+	}
+	a.fetchToken()
+}
+
+// Invalidates token if it wasn't replaced in the meantime
+func (a *Auth) expire() {
+	a.m.RLock()
+	expired := !a.expiresAt.IsZero() && !time.Now().Before(a.expiresAt)
+	a.m.RUnlock()
+	if expired && a.ctx.Err() == nil {
+		a.setValid(false)
+	}
+}
+
+// Sends single token request for the given grant type
+func (a *Auth) requestToken(grant string, creds Credentials, refreshToken string) (*http.Response, error) {
+	// Query -> buffer
+	query := url.Values{}
+	if a.scope != "" {
+		query.Add("scope", a.scope)
+	}
+	query.Add("grant_type", grant)
+	switch grant {
+	case TypeRefreshToken:
+		query.Add("refresh_token", refreshToken)
+	case TypeResourceOwner:
+		query.Add("username", creds.Username)
+		query.Add("password", creds.Password)
+	case TypeJWTBearer:
+		assertion, err := a.assertion(a.issuer, a.subject)
+		if err != nil {
+			return nil, errors.Wrap(err, "error signing assertion")
+		}
+		query.Add("assertion", assertion)
+	}
+	header := http.Header{}
+	err := a.authenticateClient(query, header, creds)
+	if err != nil {
+		return nil, err
+	}
+	body := bytes.NewBuffer([]byte(query.Encode()))
+
+	req, err := http.NewRequest("POST", a.url, body)
+	if err != nil {
+		return nil, err
+	}
+	// headers
+	req.Header = header
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+
+	return a.client.Do(req)
+}
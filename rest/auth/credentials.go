@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// Credentials - client and resource owner secrets used for token grants
+	Credentials struct {
+		ClientID string
+		Secret   string
+		Username string
+		Password string
+	}
+
+	// CredentialSource - provides credentials to Auth.
+	// Credentials are reread when Changed fires or when auth server
+	// rejects the client with invalid_client error.
+	CredentialSource interface {
+		Credentials() (Credentials, error)
+		// can return nil if source doesn't report changes
+		Changed() <-chan struct{}
+	}
+
+	FileCredentialsOptions struct {
+		ClientIDFile string `env:"AUTH_CLIENT_ID_FILE" long:"auth-client-id-file"`
+		SecretFile   string `env:"AUTH_CLIENT_SECRET_FILE" long:"auth-client-secret-file"`
+		UsernameFile string `env:"AUTH_USERNAME_FILE" long:"auth-username-file"`
+		PasswordFile string `env:"AUTH_PASSWORD_FILE" long:"auth-password-file"`
+
+		// how often files are checked for changes - 10s by default
+		Interval time.Duration `env:"AUTH_CREDENTIALS_INTERVAL" long:"auth-credentials-interval"`
+	}
+
+	staticSource struct {
+		creds Credentials
+	}
+
+	envSource struct{}
+
+	fileSource struct {
+		options FileCredentialsOptions
+		changed chan struct{}
+	}
+)
+
+var fileCredentialsInterval = 10 * time.Second
+
+// StaticCredentials - source always returning the same credentials
+func StaticCredentials(c Credentials) CredentialSource {
+	return &staticSource{creds: c}
+}
+
+func (s *staticSource) Credentials() (Credentials, error) {
+	return s.creds, nil
+}
+
+func (s *staticSource) Changed() <-chan struct{} {
+	return nil
+}
+
+// EnvCredentials - source reading AUTH_CLIENT_ID, AUTH_CLIENT_SECRET,
+// AUTH_USERNAME and AUTH_PASSWORD every time credentials are requested
+func EnvCredentials() CredentialSource {
+	return &envSource{}
+}
+
+func (s *envSource) Credentials() (Credentials, error) {
+	return Credentials{
+		ClientID: os.Getenv("AUTH_CLIENT_ID"),
+		Secret:   os.Getenv("AUTH_CLIENT_SECRET"),
+		Username: os.Getenv("AUTH_USERNAME"),
+		Password: os.Getenv("AUTH_PASSWORD"),
+	}, nil
+}
+
+func (s *envSource) Changed() <-chan struct{} {
+	return nil
+}
+
+// FileCredentials - source reading credentials from files, e.g. mounted
+// kubernetes secrets. Files are polled and Changed fires when content changes,
+// so secrets rotated in place are picked up without restart.
+// Polling stops when ctx is closed.
+func FileCredentials(ctx context.Context, options FileCredentialsOptions) (CredentialSource, error) {
+	if options.ClientIDFile == "" && options.SecretFile == "" &&
+		options.UsernameFile == "" && options.PasswordFile == "" {
+		return nil, errors.New("Auth.FileCredentials: Missing credential files")
+	}
+	if options.Interval <= 0 {
+		options.Interval = fileCredentialsInterval
+	}
+	s := &fileSource{
+		options: options,
+		changed: make(chan struct{}, 1),
+	}
+	creds, err := s.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	go s.poll(ctx, creds)
+	return s, nil
+}
+
+func (s *fileSource) Credentials() (Credentials, error) {
+	var c Credentials
+	var err error
+	if c.ClientID, err = readCredential(s.options.ClientIDFile); err != nil {
+		return c, err
+	}
+	if c.Secret, err = readCredential(s.options.SecretFile); err != nil {
+		return c, err
+	}
+	if c.Username, err = readCredential(s.options.UsernameFile); err != nil {
+		return c, err
+	}
+	c.Password, err = readCredential(s.options.PasswordFile)
+	return c, err
+}
+
+func (s *fileSource) Changed() <-chan struct{} {
+	return s.changed
+}
+
+func (s *fileSource) poll(ctx context.Context, last Credentials) {
+	ticker := time.NewTicker(s.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		creds, err := s.Credentials()
+		// file can be missing for a moment while being replaced
+		if err != nil || creds == last {
+			continue
+		}
+		last = creds
+		select {
+		case s.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// empty path means credential is not provided by the source
+func readCredential(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Auth.FileCredentials: error reading '%s'", path)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Sets source and overrides current credentials with non empty values from it
+func (a *Auth) setSource(source CredentialSource) error {
+	if source == nil {
+		return nil
+	}
+	a.source = source
+	return a.reloadCredentials()
+}
+
+func (a *Auth) reloadCredentials() error {
+	creds, err := a.source.Credentials()
+	if err != nil {
+		zerolog.Ctx(a.ctx).Error().Err(err).Msg("Auth.reloadCredentials: error reading credentials")
+		return err
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	if creds.ClientID != "" {
+		a.creds.ClientID = creds.ClientID
+	}
+	if creds.Secret != "" {
+		a.creds.Secret = creds.Secret
+	}
+	if creds.Username != "" {
+		a.creds.Username = creds.Username
+	}
+	if creds.Password != "" {
+		a.creds.Password = creds.Password
+	}
+	return nil
+}
+
+// Reloads credentials on every source change until auth ctx is closed
+func (a *Auth) watchCredentials() {
+	changed := a.source.Changed()
+	if changed == nil {
+		return
+	}
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-changed:
+			if a.reloadCredentials() == nil {
+				zerolog.Ctx(a.ctx).Info().
+					Str("clientId", a.credentials().ClientID).
+					Msg("Auth.watchCredentials: credentials reloaded")
+			}
+		}
+	}
+}
+
+// snapshot of current credentials
+func (a *Auth) credentials() Credentials {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	return a.creds
+}
+
+// Reads OAuth error code from error response body
+func oauthError(resp *http.Response) string {
+	body := struct {
+		Error string `json:"error"`
+	}{}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body)
+	return body.Error
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSecret(t *testing.T, path, value string) {
+	if err := ioutil.WriteFile(path, []byte(value+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func secretFiles(t *testing.T, id, secret string) (FileCredentialsOptions, func()) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := FileCredentialsOptions{
+		ClientIDFile: filepath.Join(dir, "client-id"),
+		SecretFile:   filepath.Join(dir, "client-secret"),
+		Interval:     5 * time.Millisecond,
+	}
+	writeSecret(t, options.ClientIDFile, id)
+	writeSecret(t, options.SecretFile, secret)
+	return options, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestEnvCredentials(t *testing.T) {
+	_ = os.Setenv("AUTH_CLIENT_ID", "koala-env")
+	defer os.Unsetenv("AUTH_CLIENT_ID")
+	c, err := EnvCredentials().Credentials()
+	assert.Nil(t, err, "Env source should not fail")
+	assert.Equal(t, "koala-env", c.ClientID, "Client ID should be read from env")
+	assert.Nil(t, EnvCredentials().Changed(), "Env source doesn't report changes")
+}
+
+func TestFileCredentials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := FileCredentials(ctx, FileCredentialsOptions{})
+	assert.NotNil(t, err, "Should return error if no files are set")
+	_, err = FileCredentials(ctx, FileCredentialsOptions{SecretFile: "/not/existing"})
+	assert.NotNil(t, err, "Should return error if file can not be read")
+
+	options, cleanup := secretFiles(t, "koala-clientID", "koala-secret")
+	defer cleanup()
+	s, err := FileCredentials(ctx, options)
+	assert.Nil(t, err, "Should not return error if files exist")
+	c, _ := s.Credentials()
+	assert.Equal(t, Credentials{ClientID: "koala-clientID", Secret: "koala-secret"}, c, "Whitespace should be trimmed")
+
+	writeSecret(t, options.SecretFile, "rotated")
+	select {
+	case <-s.Changed():
+	case <-time.After(time.Second):
+		t.Fatal("Changed should fire after file rotation")
+	}
+	c, _ = s.Credentials()
+	assert.Equal(t, "rotated", c.Secret, "Rotated secret should be returned")
+}
+
+func TestClientCredentials_Source(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	a, err := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Source:   StaticCredentials(Credentials{Secret: "static-secret"}),
+	})
+	assert.Nil(t, err, "Secret from source should satisfy validation")
+	_, _ = a.Token(ctx)
+	id, secret, _ := (&http.Request{Header: lastHeaders.Load()}).BasicAuth()
+	assert.Equal(t, "koala-clientID", id, "Option value should be kept if source value is empty")
+	assert.Equal(t, "static-secret", secret, "Secret from source should be used")
+}
+
+func TestClientCredentials_RotatedSecret(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	options, cleanup := secretFiles(t, "koala-clientID", "old-secret")
+	defer cleanup()
+	// only invalid_client response can trigger reload
+	options.Interval = time.Hour
+	source, _ := FileCredentials(ctx, options)
+	a, _ := ClientCredentials(ctx, ClientCredentialsOptions{Url: ts.URL, Source: source, Registry: registry})
+
+	token, err := a.Token(ctx)
+	assert.Nil(t, err, "Token should be fetched with current secret")
+	assert.NotEmpty(t, token, "Token should be fetched with current secret")
+
+	// secret rotated on both sides, old one is rejected with invalid_client
+	validSecret.Store("new-secret")
+	writeSecret(t, options.SecretFile, "new-secret")
+	a.Refresh()
+	token, err = a.Token(ctx)
+	assert.Nil(t, err, "Rotated secret should be picked up without restart")
+	assert.NotEmpty(t, token, "Token should be fetched with rotated secret")
+}
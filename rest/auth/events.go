@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"time"
+)
+
+type (
+	EventType string
+
+	// Event - reported to hook on token fetching state changes
+	Event struct {
+		Type EventType
+		// grant type used for the request
+		Grant string
+		// attempt number in current fetching chain, starting with 1
+		Attempt uint
+		// retry - duration of failed attempt
+		// token acquired and given up - duration of whole fetching chain
+		Duration time.Duration
+		// retry and given up only
+		Err error
+	}
+)
+
+const (
+	EventRefreshStarted EventType = "refresh_started"
+	EventTokenAcquired  EventType = "token_acquired"
+	EventRetry          EventType = "retry"
+	EventGivenUp        EventType = "given_up"
+)
+
+// SetEventHook - hook is called synchronously on every token fetching event,
+// so it should not block. Can be used to build metrics and alerts.
+func (a *Auth) SetEventHook(hook func(Event)) *Auth {
+	a.m.Lock()
+	a.hook = hook
+	a.m.Unlock()
+	return a
+}
+
+func (a *Auth) emit(e Event) {
+	a.m.RLock()
+	hook := a.hook
+	a.m.RUnlock()
+	if hook != nil {
+		hook(e)
+	}
+}
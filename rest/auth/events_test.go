@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+type eventRecorder struct {
+	m      sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) hook(e Event) {
+	r.m.Lock()
+	r.events = append(r.events, e)
+	r.m.Unlock()
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.m.Lock()
+	defer r.m.Unlock()
+	types := make([]EventType, 0)
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestAuth_SetEventHook(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	// first request will fail
+	respCode.Store(http.StatusInternalServerError)
+
+	a, _ := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	})
+	r := &eventRecorder{}
+	a.SetEventHook(r.hook)
+
+	_, err := a.Token(ctx)
+	assert.Nil(t, err, "Token should be fetched on retry")
+	assert.Equal(t, []EventType{EventRefreshStarted, EventRetry, EventTokenAcquired}, r.types(),
+		"Incorrect events reported")
+	retry := r.events[1]
+	assert.Equal(t, uint(1), retry.Attempt, "Incorrect attempt number")
+	assert.Equal(t, ErrUnreachable, errors.Cause(retry.Err), "Retry should report error")
+	acquired := r.events[2]
+	assert.Equal(t, TypeClientCredentials, acquired.Grant, "Incorrect grant reported")
+	assert.Equal(t, uint(2), acquired.Attempt, "Incorrect attempt number")
+	assert.True(t, acquired.Duration >= retry.Duration, "Acquired duration should cover whole chain")
+}
+
+func TestAuth_GivenUpLogged(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	out := &bytes.Buffer{}
+	l := zerolog.New(out)
+	ctx = l.WithContext(ctx)
+	blockResponse.Store(http.StatusUnauthorized)
+
+	a, _ := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	})
+	r := &eventRecorder{}
+	a.SetEventHook(r.hook)
+
+	_, err := a.Token(ctx)
+	assert.Equal(t, ErrInvalidCredentials, errors.Cause(err), "Token should not be fetched")
+	types := r.types()
+	assert.Equal(t, EventGivenUp, types[len(types)-1], "Giving up should be reported")
+	assert.Equal(t, int(a.maxRetries)+2, len(types), "Each retry should be reported")
+	assert.Contains(t, out.String(), `"level":"error"`, "Giving up should be logged with ctx logger")
+	assert.Contains(t, out.String(), `"clientId":"koala-clientID"`, "Log should be structured")
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// on-behalf-of token exchange (RFC 8693)
+	TokenExchangeOptions struct {
+		ClientID   string `env:"AUTH_CLIENT_ID" long:"auth-client-id"`
+		Secret     string `env:"AUTH_CLIENT_SECRET" long:"auth-client-secret"`
+		ClientAuth string `env:"AUTH_CLIENT_AUTH" long:"auth-client-auth"`
+
+		// requested audience and scope of exchanged token
+		Audience string `env:"AUTH_EXCHANGE_AUDIENCE" long:"auth-exchange-audience"`
+		Scope    string `env:"AUTH_EXCHANGE_SCOPE" long:"auth-exchange-scope"`
+
+		Url string `env:"AUTH_URL" long:"auth-url"`
+	}
+
+	// TokenExchange - exchanges incoming user tokens for downstream ones.
+	// Implements rest/client.Auth, subject token is taken from request context.
+	TokenExchange struct {
+		url        string
+		client     *http.Client
+		clientID   string
+		secret     string
+		clientAuth string
+		audience   string
+		scope      string
+
+		m     sync.Mutex
+		cache map[string]exchangedToken
+		// exchanges in progress, concurrent calls for the same token wait for them
+		calls map[string]*exchangeCall
+	}
+
+	exchangedToken struct {
+		token   string
+		expires time.Time
+	}
+
+	exchangeCall struct {
+		done  chan struct{}
+		token string
+		err   error
+		// caller's ctx was closed, waiting calls have to exchange again
+		cancelled bool
+	}
+)
+
+const TypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// exchanged tokens are dropped from cache a bit before they expire
+var exchangeExpiryMargin = 10 * time.Second
+
+// how often expired tokens are removed from cache
+var exchangeSweepInterval = time.Minute
+
+// NewTokenExchange - expired tokens are removed from cache until ctx is closed
+func NewTokenExchange(ctx context.Context, options TokenExchangeOptions) (*TokenExchange, error) {
+	e := &TokenExchange{
+		url:        os.Getenv("AUTH_URL"),
+		client:     httpClient(),
+		clientID:   options.ClientID,
+		secret:     options.Secret,
+		clientAuth: options.ClientAuth,
+		audience:   options.Audience,
+		scope:      options.Scope,
+		cache:      make(map[string]exchangedToken),
+		calls:      make(map[string]*exchangeCall),
+	}
+	if options.Url != "" {
+		e.url = options.Url
+	}
+	if e.secret == "" {
+		e.clientAuth = ClientAuthNone
+	}
+
+	if e.url == "" {
+		return nil, errors.New("Auth.NewTokenExchange: Missing authorization url")
+	}
+	if e.clientID == "" {
+		return nil, errors.New("Auth.NewTokenExchange: Missing client ID")
+	}
+	if e.audience == "" && e.scope == "" {
+		return nil, errors.New("Auth.NewTokenExchange: Missing requested audience or scope")
+	}
+	if e.clientAuth != ClientAuthNone && !secretAuth(e.clientAuth) {
+		return nil, errors.Errorf("Auth.NewTokenExchange: Unsupported client authentication '%s'", e.clientAuth)
+	}
+	go e.sweepExpired(ctx)
+	return e, nil
+}
+
+// Token - exchanges bearer token from ctx (see Validator.Middleware)
+// for token with configured audience and scope
+func (e *TokenExchange) Token(ctx context.Context) (string, error) {
+	subject := GetBearerToken(ctx)
+	if subject == "" {
+		return "", errors.Wrap(ErrMissingToken, "TokenExchange.Token: no subject token in context")
+	}
+	return e.Exchange(ctx, subject, e.audience, e.scope)
+}
+
+// Exchange - exchanges subject token for token with given audience and scope.
+// Results are cached per subject, audience and scope until they expire,
+// concurrent calls for the same token share one exchange.
+func (e *TokenExchange) Exchange(ctx context.Context, subject, audience, scope string) (string, error) {
+	key := cacheKey(subject, audience, scope)
+	for {
+		e.m.Lock()
+		cached, ok := e.cache[key]
+		if ok && time.Now().Before(cached.expires) {
+			e.m.Unlock()
+			return cached.token, nil
+		}
+		call, inProgress := e.calls[key]
+		if !inProgress {
+			call = &exchangeCall{done: make(chan struct{})}
+			e.calls[key] = call
+		}
+		e.m.Unlock()
+
+		if !inProgress {
+			e.exchange(ctx, key, call, subject, audience, scope)
+			return call.token, call.err
+		}
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrap(ctx.Err(), "TokenExchange.Exchange")
+		case <-call.done:
+		}
+		if !call.cancelled {
+			return call.token, call.err
+		}
+	}
+}
+
+// Refresh - drops cached tokens of all subjects, so next calls exchange them again.
+// rest/client uses RefreshContext instead, dropping only token of failed request.
+func (e *TokenExchange) Refresh() {
+	e.m.Lock()
+	e.cache = make(map[string]exchangedToken)
+	e.m.Unlock()
+}
+
+// RefreshContext - drops cached token exchanged for bearer token from ctx
+func (e *TokenExchange) RefreshContext(ctx context.Context) {
+	subject := GetBearerToken(ctx)
+	if subject == "" {
+		return
+	}
+	e.m.Lock()
+	delete(e.cache, cacheKey(subject, e.audience, e.scope))
+	e.m.Unlock()
+}
+
+func (e *TokenExchange) AppendHeader(ctx context.Context, h *http.Header) error {
+	token, err := e.Token(ctx)
+	if err != nil {
+		return err
+	}
+	h.Set("authorization", "Bearer "+token)
+	return nil
+}
+
+// Does exchange for call and caches its result
+func (e *TokenExchange) exchange(ctx context.Context, key string, call *exchangeCall, subject, audience, scope string) {
+	tokens, err := e.requestExchange(ctx, subject, audience, scope)
+	e.m.Lock()
+	delete(e.calls, key)
+	if err == nil && tokens.ExpiresIn > 0 {
+		expires := time.Now().Add(time.Duration(tokens.ExpiresIn)*time.Second - exchangeExpiryMargin)
+		e.cache[key] = exchangedToken{token: tokens.AccessToken, expires: expires}
+	}
+	e.m.Unlock()
+
+	if err == nil {
+		call.token = tokens.AccessToken
+	}
+	call.err = err
+	call.cancelled = ctx.Err() != nil
+	close(call.done)
+}
+
+func (e *TokenExchange) requestExchange(ctx context.Context, subject, audience, scope string) (*tokenResponse, error) {
+	query := url.Values{}
+	query.Set("grant_type", TypeTokenExchange)
+	query.Set("subject_token", subject)
+	query.Set("subject_token_type", TokenTypeAccessToken)
+	query.Set("requested_token_type", TokenTypeAccessToken)
+	if audience != "" {
+		query.Set("audience", audience)
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	header := http.Header{}
+	authenticateWithSecret(e.clientAuth, e.clientID, e.secret, query, header)
+
+	req, err := http.NewRequest("POST", e.url, bytes.NewBuffer([]byte(query.Encode())))
+	if err != nil {
+		return nil, errors.Wrapf(ErrUnreachable, "TokenExchange: error creating request: %s", err)
+	}
+	req.Header = header
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(ErrUnreachable, "TokenExchange: connection error: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode%400 < 100 {
+		return nil, errors.Wrapf(ErrInvalidCredentials, "TokenExchange: exchange rejected. Code: %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Wrapf(ErrUnreachable, "TokenExchange: auth server error. Code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(ErrMalformedResponse, "TokenExchange: error reading body: %s", err)
+	}
+	tokens := &tokenResponse{}
+	err = json.Unmarshal(body, tokens)
+	if err == nil && tokens.AccessToken == "" {
+		err = errors.New("missing access_token")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(ErrMalformedResponse, "TokenExchange: error unmarshalling body: %s", err)
+	}
+	return tokens, nil
+}
+
+// removes expired tokens from cache until ctx is closed
+func (e *TokenExchange) sweepExpired(ctx context.Context) {
+	ticker := time.NewTicker(exchangeSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		e.m.Lock()
+		for k, v := range e.cache {
+			if now.After(v.expires) {
+				delete(e.cache, k)
+			}
+		}
+		e.m.Unlock()
+	}
+}
+
+// subject tokens are hashed not to keep them as map keys
+func cacheKey(subject, audience, scope string) string {
+	h := sha256.Sum256([]byte(subject + "\x00" + audience + "\x00" + scope))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"github.com/hop-city/common/rest/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+var _ client.Auth = &TokenExchange{}
+var _ client.ContextRefresher = &TokenExchange{}
+
+func withBearer(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, bearerKey, token)
+}
+
+func TestNewTokenExchange(t *testing.T) {
+	_, err := NewTokenExchange(context.Background(), TokenExchangeOptions{Url: "a", ClientID: "koala"})
+	assert.NotNil(t, err, "Should return error if audience and scope are missing")
+	_, err = NewTokenExchange(context.Background(), TokenExchangeOptions{Url: "a", Audience: "orders"})
+	assert.NotNil(t, err, "Should return error if client ID is missing")
+}
+
+func TestTokenExchange_Token(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	e, err := NewTokenExchange(ctx, TokenExchangeOptions{
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+		Audience: "orders",
+		Scope:    "orders:read",
+	})
+	assert.Nil(t, err, "Should not return error if all options are set")
+
+	_, err = e.Token(ctx)
+	assert.Equal(t, ErrMissingToken, errors.Cause(err), "Subject token is required")
+	assert.Equal(t, 0, reqCount.Load(), "No request should be done without subject token")
+
+	nextBody.Store(`{"access_token": "exchanged", "expires_in": 60}`)
+	token, err := e.Token(withBearer(ctx, "user-token"))
+	assert.Nil(t, err, "Should not return error if token was exchanged")
+	assert.Equal(t, "exchanged", token, "Supplied token doesn't match send token")
+	assert.Equal(t, TypeTokenExchange, lastQuery.Load().Get("grant_type"), "Received incorrect grant type")
+	assert.Equal(t, "user-token", lastQuery.Load().Get("subject_token"), "Received incorrect subject token")
+	assert.Equal(t, TokenTypeAccessToken, lastQuery.Load().Get("subject_token_type"), "Received incorrect token type")
+	assert.Equal(t, "orders", lastQuery.Load().Get("audience"), "Received incorrect audience")
+	assert.Equal(t, "orders:read", lastQuery.Load().Get("scope"), "Received incorrect scope")
+	assert.NotEmpty(t, lastHeaders.Load().Get("authorization"), "Client should be authenticated")
+
+	_, _ = e.Token(withBearer(ctx, "user-token"))
+	assert.Equal(t, 1, reqCount.Load(), "Exchanged token should be cached")
+	_, _ = e.Exchange(ctx, "user-token", "users", "")
+	assert.Equal(t, 2, reqCount.Load(), "Cache should be kept per audience")
+	_, _ = e.Token(withBearer(ctx, "other-token"))
+	assert.Equal(t, 3, reqCount.Load(), "Cache should be kept per subject")
+
+	e.Refresh()
+	_, _ = e.Token(withBearer(ctx, "user-token"))
+	assert.Equal(t, 4, reqCount.Load(), "Refresh should drop cached tokens")
+
+	// without expiry tokens are not cached
+	nextBody.Store(`{"access_token": "exchanged"}`)
+	_, _ = e.Token(withBearer(ctx, "third-token"))
+	_, _ = e.Token(withBearer(ctx, "third-token"))
+	assert.Equal(t, 6, reqCount.Load(), "Tokens without expiry should not be cached")
+
+	blockResponse.Store(http.StatusBadRequest)
+	_, err = e.Token(withBearer(ctx, "rejected-token"))
+	assert.Equal(t, ErrInvalidCredentials, errors.Cause(err), "Rejected exchange should return error")
+}
+
+func TestTokenExchange_RefreshContext(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	e, _ := NewTokenExchange(ctx, TokenExchangeOptions{
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Audience: "orders",
+	})
+	nextBody.Store(`{"access_token": "exchanged", "expires_in": 60}`)
+
+	_, _ = e.Token(withBearer(ctx, "user-a"))
+	_, _ = e.Token(withBearer(ctx, "user-b"))
+	assert.Equal(t, 2, reqCount.Load())
+	e.RefreshContext(withBearer(ctx, "user-a"))
+	_, _ = e.Token(withBearer(ctx, "user-a"))
+	_, _ = e.Token(withBearer(ctx, "user-b"))
+	assert.Equal(t, 3, reqCount.Load(), "Only token of refreshed subject should be exchanged again")
+}
+
+func TestTokenExchange_Concurrent(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	e, _ := NewTokenExchange(ctx, TokenExchangeOptions{
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Audience: "orders",
+	})
+	nextBody.Store(`{"access_token": "exchanged", "expires_in": 60}`)
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], _ = e.Token(withBearer(ctx, "user-token"))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, reqCount.Load(), "Concurrent calls should share one exchange")
+	assert.Equal(t, []string{"exchanged", "exchanged", "exchanged", "exchanged", "exchanged"}, tokens)
+}
+
+func TestTokenExchange_Client(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	e, _ := NewTokenExchange(ctx, TokenExchangeOptions{
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Audience: "orders",
+	})
+
+	var authHeader string
+	reject := false
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("authorization")
+		if reject {
+			reject = false
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer downstream.Close()
+
+	nextBody.Store(`{"access_token": "exchanged", "expires_in": 60}`)
+	c := client.New(ctx, e).SetMaxRetries(1)
+	_, err := c.Fetch(client.FetchOptions{
+		Ctx:    withBearer(ctx, "user-token"),
+		Method: "GET",
+		Url:    downstream.URL,
+	})
+	assert.Nil(t, err, "Request should succeed")
+	assert.Equal(t, "Bearer exchanged", authHeader, "Exchanged token should be sent downstream")
+	assert.Equal(t, "koala-clientID", lastQuery.Load().Get("client_id"), "Client ID should be sent without secret")
+
+	// 401 drops only token of request's subject
+	_, _ = e.Token(withBearer(ctx, "other-token"))
+	reject = true
+	_, err = c.Fetch(client.FetchOptions{
+		Ctx:    withBearer(ctx, "user-token"),
+		Method: "GET",
+		Url:    downstream.URL,
+	})
+	assert.Nil(t, err, "Request should be retried after 401")
+	assert.Equal(t, 3, reqCount.Load(), "Token of failed request should be exchanged again")
+	_, _ = e.Token(withBearer(ctx, "other-token"))
+	assert.Equal(t, 3, reqCount.Load(), "Tokens of other subjects should stay cached")
+}
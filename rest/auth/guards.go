@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"github.com/hop-city/common/rest/server"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+)
+
+// ErrForbidden - validated token doesn't carry required scopes
+var ErrForbidden = errors.New("rest/auth: insufficient scope")
+
+// ErrClaimMismatch - validated token doesn't carry required claim value
+var ErrClaimMismatch = errors.New("rest/auth: required claim missing")
+
+// Scopes - returns token scopes from space separated scope claim
+// and from scp claim, which can be an array or a string
+func (c Claims) Scopes() []string {
+	scopes := strings.Fields(c.String("scope"))
+	for _, s := range c.Strings("scp") {
+		scopes = append(scopes, strings.Fields(s)...)
+	}
+	return scopes
+}
+
+// RequireScopes - allows request only if token carries all of the scopes
+func RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return guard(scopeChallenge(scopes), ErrForbidden, func(c Claims) bool {
+		has := c.Scopes()
+		for _, s := range scopes {
+			if !contains(has, s) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// RequireAnyScope - allows request if token carries at least one of the scopes
+func RequireAnyScope(scopes ...string) func(http.Handler) http.Handler {
+	return guard(scopeChallenge(scopes), ErrForbidden, func(c Claims) bool {
+		has := c.Scopes()
+		for _, s := range scopes {
+			if contains(has, s) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RequireClaim - allows request if claim equals value or, for array claims, contains it.
+// Rejected requests get ErrClaimMismatch without challenge, as token scope is not the issue.
+func RequireClaim(key, value string) func(http.Handler) http.Handler {
+	return guard("", ErrClaimMismatch, func(c Claims) bool {
+		return contains(c.Strings(key), value)
+	})
+}
+
+func scopeChallenge(scopes []string) string {
+	return `Bearer error="insufficient_scope", scope="` + strings.Join(scopes, " ") + `"`
+}
+
+// Builds middleware rejecting requests that don't satisfy check with 403 and err.
+// Claims are expected in context - see Validator.Middleware.
+func guard(challenge string, err error, check func(Claims) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := GetClaims(r.Context())
+			if claims == nil {
+				w.Header().Set("www-authenticate", "Bearer")
+				_ = server.Respond(w, http.StatusUnauthorized, ErrMissingToken)
+				return
+			}
+			if !check(claims) {
+				if challenge != "" {
+					w.Header().Set("www-authenticate", challenge)
+				}
+				_ = server.Respond(w, http.StatusForbidden, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"github.com/hop-city/common/rest/server"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// puts claims into context the same way Validator.Middleware does
+func withClaims(claims Claims) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if claims != nil {
+				r = r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func guardStatus(claims Claims, guard func(http.Handler) http.Handler) (int, string) {
+	r := server.CreateRouter()
+	r.Use(withClaims(claims))
+	r.With(guard).Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	b, _ := ioutil.ReadAll(rec.Body)
+	return rec.Code, string(b)
+}
+
+func TestClaims_Scopes(t *testing.T) {
+	c := Claims{"scope": "orders:read orders:write"}
+	assert.Equal(t, []string{"orders:read", "orders:write"}, c.Scopes(), "Space separated scope should be split")
+	c = Claims{"scp": []interface{}{"orders:read", "users:read"}}
+	assert.Equal(t, []string{"orders:read", "users:read"}, c.Scopes(), "scp array should be read")
+	c = Claims{"scope": "a", "scp": "b c"}
+	assert.Equal(t, []string{"a", "b", "c"}, c.Scopes(), "Both claims should be merged")
+	assert.Empty(t, Claims{}.Scopes(), "No scopes expected")
+}
+
+func TestRequireScopes(t *testing.T) {
+	claims := Claims{"scope": "orders:read orders:write"}
+	code, _ := guardStatus(claims, RequireScopes("orders:read", "orders:write"))
+	assert.Equal(t, http.StatusOK, code, "All scopes are present")
+
+	code, body := guardStatus(claims, RequireScopes("orders:write", "users:write"))
+	assert.Equal(t, http.StatusForbidden, code, "One of scopes is missing")
+	assert.Equal(t, ErrForbidden.Error(), body, "Consistent body should be returned")
+
+	code, _ = guardStatus(nil, RequireScopes("orders:read"))
+	assert.Equal(t, http.StatusUnauthorized, code, "No claims in context")
+}
+
+func TestRequireAnyScope(t *testing.T) {
+	claims := Claims{"scp": []interface{}{"orders:read"}}
+	code, _ := guardStatus(claims, RequireAnyScope("orders:write", "orders:read"))
+	assert.Equal(t, http.StatusOK, code, "One of scopes is present")
+
+	code, _ = guardStatus(claims, RequireAnyScope("users:read", "users:write"))
+	assert.Equal(t, http.StatusForbidden, code, "None of scopes is present")
+}
+
+func TestRequireClaim(t *testing.T) {
+	claims := Claims{"tenant": "koala", "roles": []interface{}{"admin", "user"}}
+	code, _ := guardStatus(claims, RequireClaim("tenant", "koala"))
+	assert.Equal(t, http.StatusOK, code, "String claim matches")
+	code, _ = guardStatus(claims, RequireClaim("roles", "admin"))
+	assert.Equal(t, http.StatusOK, code, "Array claim contains value")
+
+	code, _ = guardStatus(claims, RequireClaim("tenant", "panda"))
+	assert.Equal(t, http.StatusForbidden, code, "String claim doesn't match")
+	code, body := guardStatus(claims, RequireClaim("groups", "admin"))
+	assert.Equal(t, http.StatusForbidden, code, "Missing claim")
+	assert.Equal(t, ErrClaimMismatch.Error(), body, "Claim specific body should be returned")
+}
@@ -2,8 +2,10 @@ package auth
 
 import (
 	"context"
+	"crypto"
 	"github.com/pkg/errors"
 	"net/http"
+	"time"
 )
 
 type (
@@ -12,7 +14,18 @@ type (
 		Secret   string `env:"AUTH_CLIENT_SECRET" long:"auth-client-secret"`
 		Scope    string `env:"AUTH_CLIENT_SCOPE" long:"auth-client-scope"`
 
+		// client_secret_basic (default) or client_secret_post
+		ClientAuth string `env:"AUTH_CLIENT_AUTH" long:"auth-client-auth"`
+
 		Url string `env:"AUTH_URL" long:"auth-url"`
+
+		// how long before expiry token is renewed in background - 30s by default
+		RenewBefore time.Duration `env:"AUTH_RENEW_BEFORE" long:"auth-renew-before"`
+
+		// overrides credentials above when set, see FileCredentials and EnvCredentials
+		Source CredentialSource `no-flag:"true"`
+		// registry reporting token state - DefaultRegistry() if nil
+		Registry *Registry `no-flag:"true"`
 	}
 	ResourceOwnerOptions struct {
 		ClientID string `env:"AUTH_CLIENT_ID" long:"auth-client-id"`
@@ -22,16 +35,85 @@ type (
 		Username string `env:"AUTH_USERNAME" long:"auth-username"`
 		Password string `env:"AUTH_PASSWORD" long:"auth-password"`
 
+		// client_secret_basic (default) or client_secret_post
+		ClientAuth string `env:"AUTH_CLIENT_AUTH" long:"auth-client-auth"`
+
 		Url string `env:"AUTH_URL" long:"auth-url"`
+
+		// how long before expiry token is renewed in background - 30s by default
+		RenewBefore time.Duration `env:"AUTH_RENEW_BEFORE" long:"auth-renew-before"`
+
+		// overrides credentials above when set, see FileCredentials and EnvCredentials
+		Source CredentialSource `no-flag:"true"`
+		// registry reporting token state - DefaultRegistry() if nil
+		Registry *Registry `no-flag:"true"`
+	}
+	// client credentials grant with client authenticated by signed JWT (private_key_jwt)
+	PrivateKeyJWTOptions struct {
+		ClientID string `env:"AUTH_CLIENT_ID" long:"auth-client-id"`
+		Scope    string `env:"AUTH_CLIENT_SCOPE" long:"auth-client-scope"`
+
+		// RSA/EC signing key, first one set is used: already parsed Key,
+		// PEM encoded PrivateKey or path to PEM file in PrivateKeyFile
+		PrivateKey     string        `env:"AUTH_PRIVATE_KEY" long:"auth-private-key"`
+		PrivateKeyFile string        `env:"AUTH_PRIVATE_KEY_FILE" long:"auth-private-key-file"`
+		Key            crypto.Signer `no-flag:"true"`
+		KeyID          string        `env:"AUTH_KEY_ID" long:"auth-key-id"`
+		// assertion aud claim - token url by default
+		Audience string `env:"AUTH_ASSERTION_AUDIENCE" long:"auth-assertion-audience"`
+
+		Url string `env:"AUTH_URL" long:"auth-url"`
+
+		// how long before expiry token is renewed in background - 30s by default
+		RenewBefore time.Duration `env:"AUTH_RENEW_BEFORE" long:"auth-renew-before"`
+		// registry reporting token state - DefaultRegistry() if nil
+		Registry *Registry `no-flag:"true"`
+	}
+	// JWT bearer assertion grant (RFC 7523)
+	JWTBearerOptions struct {
+		// client authentication is optional - with empty secret only client_id is sent
+		ClientID   string `env:"AUTH_CLIENT_ID" long:"auth-client-id"`
+		Secret     string `env:"AUTH_CLIENT_SECRET" long:"auth-client-secret"`
+		ClientAuth string `env:"AUTH_CLIENT_AUTH" long:"auth-client-auth"`
+		Scope      string `env:"AUTH_CLIENT_SCOPE" long:"auth-client-scope"`
+
+		// assertion iss claim - client ID by default
+		Issuer  string `env:"AUTH_ASSERTION_ISSUER" long:"auth-assertion-issuer"`
+		Subject string `env:"AUTH_ASSERTION_SUBJECT" long:"auth-assertion-subject"`
+		// assertion aud claim - token url by default
+		Audience string `env:"AUTH_ASSERTION_AUDIENCE" long:"auth-assertion-audience"`
+
+		// RSA/EC signing key, first one set is used: already parsed Key,
+		// PEM encoded PrivateKey or path to PEM file in PrivateKeyFile
+		PrivateKey     string        `env:"AUTH_PRIVATE_KEY" long:"auth-private-key"`
+		PrivateKeyFile string        `env:"AUTH_PRIVATE_KEY_FILE" long:"auth-private-key-file"`
+		Key            crypto.Signer `no-flag:"true"`
+		KeyID          string        `env:"AUTH_KEY_ID" long:"auth-key-id"`
+
+		Url string `env:"AUTH_URL" long:"auth-url"`
+
+		// how long before expiry token is renewed in background - 30s by default
+		RenewBefore time.Duration `env:"AUTH_RENEW_BEFORE" long:"auth-renew-before"`
+		// registry reporting token state - DefaultRegistry() if nil
+		Registry *Registry `no-flag:"true"`
 	}
 )
 
 const TypeResourceOwner = "password"
 const TypeClientCredentials = "client_credentials"
+const TypeRefreshToken = "refresh_token"
+const TypeJWTBearer = "urn:ietf:params:oauth:grant-type:jwt-bearer"
 
+// client authentication methods
+const ClientAuthBasic = "client_secret_basic"
+const ClientAuthPost = "client_secret_post"
+const ClientAuthPrivateKeyJWT = "private_key_jwt"
+const ClientAuthNone = "none"
+
+// WatchGlobalReady - watches ready state of DefaultRegistry.
+// Deprecated: use Registry.Watch.
 func WatchGlobalReady(callback func(bool)) {
-	readyCallbacks = append(readyCallbacks, callback)
-	callback(globalReadyStatus())
+	DefaultRegistry().Watch(callback)
 }
 
 // Resource owner grant type
@@ -44,30 +126,41 @@ func ResourceOwner(ctx context.Context, options ResourceOwnerOptions) (*Auth, er
 
 	a.ctx = ctx
 
-	a.clientID = options.ClientID
-	a.secret = options.Secret
+	a.creds = Credentials{
+		ClientID: options.ClientID,
+		Secret:   options.Secret,
+		Username: options.Username,
+		Password: options.Password,
+	}
 	a.scope = options.Scope
-
-	a.username = options.Username
-	a.password = options.Password
+	if err := a.setSource(options.Source); err != nil {
+		return nil, errors.Wrap(err, "Auth.ResourceOwner")
+	}
+	a.clientAuth = options.ClientAuth
+	if options.RenewBefore > 0 {
+		a.renewBefore = options.RenewBefore
+	}
 
 	if a.url == "" {
 		return nil, errors.New("Auth.ResourceOwner: Missing authorization url")
 	}
-	if a.secret == "" {
+	if a.creds.Secret == "" {
 		return nil, errors.New("Auth.ResourceOwner: Missing client secret")
 	}
-	if a.clientID == "" {
+	if a.creds.ClientID == "" {
 		return nil, errors.New("Auth.ResourceOwner: Missing client ID")
 	}
-	if a.username == "" {
+	if a.creds.Username == "" {
 		return nil, errors.New("Auth.ResourceOwner: Missing username")
 	}
-	if a.password == "" {
+	if a.creds.Password == "" {
 		return nil, errors.New("Auth.ResourceOwner: Missing password")
 	}
+	if !secretAuth(a.clientAuth) {
+		return nil, errors.Errorf("Auth.ResourceOwner: Unsupported client authentication '%s'", a.clientAuth)
+	}
 
-	return a, nil
+	return a.register(options.Registry), nil
 }
 
 func ClientCredentials(ctx context.Context, options ClientCredentialsOptions) (*Auth, error) {
@@ -78,49 +171,189 @@ func ClientCredentials(ctx context.Context, options ClientCredentialsOptions) (*
 	}
 
 	a.ctx = ctx
-	a.clientID = options.ClientID
-	a.secret = options.Secret
+	a.creds = Credentials{
+		ClientID: options.ClientID,
+		Secret:   options.Secret,
+	}
 	a.scope = options.Scope
+	if err := a.setSource(options.Source); err != nil {
+		return nil, errors.Wrap(err, "Auth.ClientCredentials")
+	}
+	a.clientAuth = options.ClientAuth
+	if options.RenewBefore > 0 {
+		a.renewBefore = options.RenewBefore
+	}
 
 	if a.url == "" {
 		return nil, errors.New("Auth.ClientCredentials: Missing authorization url")
 	}
-	if a.secret == "" {
+	if a.creds.Secret == "" {
 		return nil, errors.New("Auth.ClientCredentials: Missing client secret")
 	}
-	if a.clientID == "" {
+	if a.creds.ClientID == "" {
 		return nil, errors.New("Auth.ClientCredentials: Missing client ID")
 	}
-	if a.clientID == "" {
+	if a.creds.ClientID == "" {
 		return nil, errors.New("Auth.ClientCredentials: Missing requested scope")
 	}
+	if !secretAuth(a.clientAuth) {
+		return nil, errors.Errorf("Auth.ClientCredentials: Unsupported client authentication '%s'", a.clientAuth)
+	}
 
-	return a, nil
+	return a.register(options.Registry), nil
+}
+
+// Client credentials grant with private_key_jwt client authentication
+func PrivateKeyJWT(ctx context.Context, options PrivateKeyJWTOptions) (*Auth, error) {
+	a := authBase()
+	a.typ = TypeClientCredentials
+	a.clientAuth = ClientAuthPrivateKeyJWT
+	if options.Url != "" {
+		a.url = options.Url
+	}
+
+	a.ctx = ctx
+	a.creds = Credentials{ClientID: options.ClientID}
+	a.scope = options.Scope
+	a.keyID = options.KeyID
+	a.audience = options.Audience
+	if options.RenewBefore > 0 {
+		a.renewBefore = options.RenewBefore
+	}
+
+	if a.url == "" {
+		return nil, errors.New("Auth.PrivateKeyJWT: Missing authorization url")
+	}
+	if a.creds.ClientID == "" {
+		return nil, errors.New("Auth.PrivateKeyJWT: Missing client ID")
+	}
+	err := a.setKey(options.Key, options.PrivateKey, options.PrivateKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Auth.PrivateKeyJWT")
+	}
+
+	return a.register(options.Registry), nil
+}
+
+// JWT bearer assertion grant - token is requested with assertion signed by private key
+func JWTBearer(ctx context.Context, options JWTBearerOptions) (*Auth, error) {
+	a := authBase()
+	a.typ = TypeJWTBearer
+	if options.Url != "" {
+		a.url = options.Url
+	}
+
+	a.ctx = ctx
+	a.creds = Credentials{
+		ClientID: options.ClientID,
+		Secret:   options.Secret,
+	}
+	a.scope = options.Scope
+	a.clientAuth = options.ClientAuth
+	if a.creds.Secret == "" {
+		a.clientAuth = ClientAuthNone
+	}
+	a.issuer = options.Issuer
+	if a.issuer == "" {
+		a.issuer = a.creds.ClientID
+	}
+	a.subject = options.Subject
+	a.keyID = options.KeyID
+	a.audience = options.Audience
+	if options.RenewBefore > 0 {
+		a.renewBefore = options.RenewBefore
+	}
+
+	if a.url == "" {
+		return nil, errors.New("Auth.JWTBearer: Missing authorization url")
+	}
+	if a.issuer == "" {
+		return nil, errors.New("Auth.JWTBearer: Missing assertion issuer")
+	}
+	if a.subject == "" {
+		return nil, errors.New("Auth.JWTBearer: Missing assertion subject")
+	}
+	if a.clientAuth != ClientAuthNone && !secretAuth(a.clientAuth) {
+		return nil, errors.Errorf("Auth.JWTBearer: Unsupported client authentication '%s'", a.clientAuth)
+	}
+	err := a.setKey(options.Key, options.PrivateKey, options.PrivateKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Auth.JWTBearer")
+	}
+
+	return a.register(options.Registry), nil
+}
+
+// client authentication methods that use secret
+func secretAuth(method string) bool {
+	return method == "" || method == ClientAuthBasic || method == ClientAuthPost
+}
+
+func (a *Auth) setKey(key crypto.Signer, pemKey string, file string) error {
+	key, err := loadPrivateKey(key, pemKey, file)
+	if err != nil {
+		return err
+	}
+	alg, err := signingAlg(key)
+	if err != nil {
+		return err
+	}
+	a.key = key
+	a.alg = alg
+	return nil
 }
 
 // Interaction
-func (a *Auth) GetToken() <-chan string {
-	ch := make(chan string, 1)
+
+// Token returns valid access token. It blocks until token is fetched,
+// ctx is closed or fetching is given up. Errors can be checked with
+// errors.Cause against ErrInvalidCredentials, ErrUnreachable and
+// ErrMalformedResponse.
+func (a *Auth) Token(ctx context.Context) (string, error) {
 	if a.valid.Load().(bool) {
 		a.m.RLock()
-		ch <- a.tokens.AccessToken
-		a.m.RUnlock()
-		return ch
+		defer a.m.RUnlock()
+		return a.tokens.AccessToken, nil
 	}
+	ch := make(chan tokenResult, 1)
 	a.m.Lock()
 	a.tokenRequests = append(a.tokenRequests, ch)
 	a.m.Unlock()
 	go a.distributeTokens()
+
+	select {
+	case res := <-ch:
+		return res.token, res.err
+	case <-ctx.Done():
+		return "", errors.Wrap(ctx.Err(), "Auth.Token")
+	case <-a.ctx.Done():
+		return "", errors.Wrap(a.ctx.Err(), "Auth.Token: auth closed")
+	}
+}
+
+// GetToken returns channel that receives token once it is available.
+// Nothing is sent if token can not be acquired - prefer Token.
+func (a *Auth) GetToken() <-chan string {
+	ch := make(chan string, 1)
+	go func() {
+		token, err := a.Token(a.ctx)
+		if err == nil {
+			ch <- token
+		}
+	}()
 	return ch
 }
 
-func (a *Auth) AppendHeader(h *http.Header) {
-	token := <-a.GetToken()
+func (a *Auth) AppendHeader(ctx context.Context, h *http.Header) error {
+	token, err := a.Token(ctx)
+	if err != nil {
+		return err
+	}
 	h.Set("authorization", "Bearer "+token)
+	return nil
 }
 
 func (a *Auth) Refresh() {
-	a.reqCount = 0
 	a.setValid(false)
 	a.fetchToken()
 }
@@ -2,7 +2,10 @@ package auth
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/http"
@@ -10,45 +13,174 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
 
-var respCode = http.StatusInternalServerError
-var blockResponse = 0
-var nextBody = "-default-"
-var reqCount = 0
-var lastQuery url.Values
-var lastHeaders http.Header
+// fake auth server state - shared by tests and handler goroutines
+var respCode = &syncInt{v: http.StatusInternalServerError}
+var blockResponse = &syncInt{}
+var nextBody = &syncString{v: "-default-"}
+var reqCount = &syncInt{}
+var lastQuery = &syncQuery{}
+var lastHeaders = &syncHeader{}
+var rejectRefresh = &syncBool{}
+var validSecret = &syncString{}
+var grants = &syncStrings{}
 var ts *httptest.Server
+var registry *Registry
+
+type (
+	syncInt struct {
+		m sync.Mutex
+		v int
+	}
+	syncString struct {
+		m sync.Mutex
+		v string
+	}
+	syncBool struct {
+		m sync.Mutex
+		v bool
+	}
+	syncQuery struct {
+		m sync.Mutex
+		v url.Values
+	}
+	syncHeader struct {
+		m sync.Mutex
+		v http.Header
+	}
+	syncStrings struct {
+		m sync.Mutex
+		v []string
+	}
+)
+
+func (s *syncInt) Load() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.v
+}
+
+func (s *syncInt) Store(v int) {
+	s.m.Lock()
+	s.v = v
+	s.m.Unlock()
+}
+
+func (s *syncInt) Add(delta int) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.v += delta
+	return s.v
+}
+
+func (s *syncString) Load() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.v
+}
+
+func (s *syncString) Store(v string) {
+	s.m.Lock()
+	s.v = v
+	s.m.Unlock()
+}
+
+func (s *syncBool) Load() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.v
+}
+
+func (s *syncBool) Store(v bool) {
+	s.m.Lock()
+	s.v = v
+	s.m.Unlock()
+}
+
+func (s *syncQuery) Load() url.Values {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.v
+}
+
+func (s *syncQuery) Store(v url.Values) {
+	s.m.Lock()
+	s.v = v
+	s.m.Unlock()
+}
+
+func (s *syncHeader) Load() http.Header {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.v
+}
+
+func (s *syncHeader) Store(v http.Header) {
+	s.m.Lock()
+	s.v = v
+	s.m.Unlock()
+}
+
+func (s *syncStrings) Load() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]string{}, s.v...)
+}
+
+func (s *syncStrings) Store(v []string) {
+	s.m.Lock()
+	s.v = v
+	s.m.Unlock()
+}
+
+func (s *syncStrings) Append(v string) {
+	s.m.Lock()
+	s.v = append(s.v, v)
+	s.m.Unlock()
+}
 
 func TestMain(m *testing.M) {
-	_ = os.Setenv("AUTH_TIMEOUT", "10")
+	_ = os.Setenv("AUTH_TIMEOUT", "100")
 
 	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		<-time.After(time.Millisecond * 5)
-		reqCount++
+		count := reqCount.Add(1)
 		b, _ := ioutil.ReadAll(req.Body)
 		query, _ := url.ParseQuery(string(b))
-		lastQuery = query
-		lastHeaders = req.Header
-
-		if blockResponse != 0 {
-			w.WriteHeader(blockResponse)
+		lastQuery.Store(query)
+		lastHeaders.Store(req.Header)
+		grants.Append(query.Get("grant_type"))
+
+		if rejectRefresh.Load() && query.Get("grant_type") == TypeRefreshToken {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		if _, secret, _ := req.BasicAuth(); validSecret.Load() != "" && secret != validSecret.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		if block := blockResponse.Load(); block != 0 {
+			w.WriteHeader(block)
 		} else {
-			w.WriteHeader(respCode)
+			w.WriteHeader(respCode.Load())
 		}
 
-		if nextBody != "-default-" {
-			_, _ = w.Write([]byte(nextBody))
+		if body := nextBody.Load(); body != "-default-" {
+			_, _ = w.Write([]byte(body))
 		} else {
 			_, _ = w.Write([]byte(
-				`{"access_token": "` + strconv.Itoa(reqCount) + `"}`,
+				`{"access_token": "` + strconv.Itoa(count) + `"}`,
 			))
 		}
 
 		// 2+ request will succeed
-		respCode = http.StatusOK
+		respCode.Store(http.StatusOK)
 	}))
 	defer ts.Close()
 	retryWait.SetBaseDuration(1)
@@ -63,14 +195,16 @@ func shutdown() {
 
 func clear() (context.Context, func()) {
 	<-time.After(time.Millisecond * 10)
-	blockResponse = 0
-	respCode = http.StatusOK
-	reqCount = 0
-	nextBody = "-default-"
-	lastQuery = nil
-	lastHeaders = nil
-	authList = make([]*Auth, 0)
-	readyCallbacks = make([]func(bool), 0)
+	blockResponse.Store(0)
+	respCode.Store(http.StatusOK)
+	reqCount.Store(0)
+	nextBody.Store("-default-")
+	lastQuery.Store(nil)
+	lastHeaders.Store(nil)
+	rejectRefresh.Store(false)
+	validSecret.Store("")
+	grants.Store(nil)
+	registry = NewRegistry("")
 
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
@@ -104,7 +238,9 @@ func TestWatchGlobalReady(t *testing.T) {
 		ClientID: "koID",
 		Secret:   "koSec",
 	})
-	assert.Equal(t, 2, len(authList), "2 Auth objects should be on the list")
+	DefaultRegistry().m.Lock()
+	assert.Equal(t, 2, len(DefaultRegistry().auths), "2 Auth objects should be on the list")
+	DefaultRegistry().m.Unlock()
 	assert.False(t, statusChanges[2],
 		"Creating new Auth should revert ready to false")
 	a2.setValid(true)
@@ -118,13 +254,13 @@ func TestResourceOwner(t *testing.T) {
 	ctx, cancel := clear()
 	defer cancel()
 	statusChanges := make([]bool, 0)
-	WatchGlobalReady(func(status bool) {
+	registry.Watch(func(status bool) {
 		statusChanges = append(statusChanges, status)
 	})
 
 	// first request will fail
-	respCode = http.StatusInternalServerError
-	reqCount = 0
+	respCode.Store(http.StatusInternalServerError)
+	reqCount.Store(0)
 
 	clientID := "koala-clientID"
 	secret := "koala-secret"
@@ -133,6 +269,7 @@ func TestResourceOwner(t *testing.T) {
 			[]byte(clientID+":"+secret),
 		)
 	a, err := ResourceOwner(ctx, ResourceOwnerOptions{
+		Registry: registry,
 		Url:      ts.URL,
 		Username: "koala",
 		Password: "pass",
@@ -151,22 +288,22 @@ func TestResourceOwner(t *testing.T) {
 		assert.Fail(t, "Token not received")
 	}
 
-	assert.Equal(t, "koala", lastQuery.Get("username"), "Received incorrect username")
-	assert.Equal(t, "pass", lastQuery.Get("password"), "Received incorrect password")
-	assert.Equal(t, "password", lastQuery.Get("grant_type"), "Received incorrect grant type")
-	assert.Equal(t, authHeader, lastHeaders.Get("authorization"), "Received incorrect header")
+	assert.Equal(t, "koala", lastQuery.Load().Get("username"), "Received incorrect username")
+	assert.Equal(t, "pass", lastQuery.Load().Get("password"), "Received incorrect password")
+	assert.Equal(t, "password", lastQuery.Load().Get("grant_type"), "Received incorrect grant type")
+	assert.Equal(t, authHeader, lastHeaders.Load().Get("authorization"), "Received incorrect header")
 
 	// ready should be true
-	assert.True(t, globalReadyStatus(), "We have retrieved the token, so global ready status should be true")
-	respCode = http.StatusInternalServerError
+	assert.True(t, registry.IsReady(), "We have retrieved the token, so global ready status should be true")
+	respCode.Store(http.StatusInternalServerError)
 	go a.Refresh()
 	<-time.After(time.Millisecond)
-	assert.False(t, globalReadyStatus(), "We have asked for refresh - global ready status should immediately be false")
+	assert.False(t, registry.IsReady(), "We have asked for refresh - global ready status should immediately be false")
 
 	select {
 	case token = <-a.GetToken():
 		assert.Equal(t, "4", token, "Supplied token doesn't match send token")
-		assert.True(t, globalReadyStatus(), "We have retrieved the token, so global ready status should be true")
+		assert.True(t, registry.IsReady(), "We have retrieved the token, so global ready status should be true")
 	case <-time.After(time.Millisecond * 50):
 		assert.Fail(t, "Token not received")
 	}
@@ -185,6 +322,7 @@ func TestClient(t *testing.T) {
 	//	)
 	a, err := ClientCredentials(ctx, ClientCredentialsOptions{
 		//a, err := ResourceOwner(ctx, ResourceOwnerOptions{
+		Registry: registry,
 		Url:      ts.URL,
 		ClientID: clientID,
 		Secret:   secret,
@@ -216,27 +354,107 @@ func TestAuth_AppendHeader(t *testing.T) {
 	//		[]byte(clientID+":"+secret),
 	//	)
 	a, err := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry: registry,
 		Url:      ts.URL,
 		ClientID: clientID,
 		Secret:   secret,
 	})
 	assert.Nil(t, err, "Should not return error if all options are set")
 	header := http.Header{}
-	a.AppendHeader(&header)
+	err = a.AppendHeader(ctx, &header)
+	assert.Nil(t, err, "Should not return error if token was fetched")
 	assert.Equal(t, "Bearer 1", header.Get("authorization"), "Invalid or no token appended")
 }
 
+func TestAuth_Token(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	a, err := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	})
+	assert.Nil(t, err, "Should not return error if all options are set")
+
+	token, err := a.Token(ctx)
+	assert.Nil(t, err, "Should not return error if token was fetched")
+	assert.Equal(t, "1", token, "Supplied token doesn't match send token")
+}
+
+func TestAuth_Token_Errors(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	options := ClientCredentialsOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	}
+
+	blockResponse.Store(http.StatusUnauthorized)
+	a, _ := ClientCredentials(ctx, options)
+	_, err := a.Token(ctx)
+	assert.Equal(t, ErrInvalidCredentials, errors.Cause(err), "4xx should be reported as invalid credentials")
+	header := http.Header{}
+	err = a.AppendHeader(ctx, &header)
+	assert.Equal(t, ErrInvalidCredentials, errors.Cause(err), "AppendHeader should return token error")
+	assert.Empty(t, header.Get("authorization"), "No header should be set on error")
+
+	blockResponse.Store(http.StatusServiceUnavailable)
+	a, _ = ClientCredentials(ctx, options)
+	_, err = a.Token(ctx)
+	assert.Equal(t, ErrUnreachable, errors.Cause(err), "5xx should be reported as unreachable")
+
+	blockResponse.Store(0)
+	nextBody.Store(`{"":"koala",`)
+	a, _ = ClientCredentials(ctx, options)
+	_, err = a.Token(ctx)
+	assert.Equal(t, ErrMalformedResponse, errors.Cause(err), "Invalid JSON should be reported as malformed")
+
+	nextBody.Store("-default-")
+	options.Url = "http://127.0.0.1:1"
+	a, _ = ClientCredentials(ctx, options)
+	_, err = a.Token(ctx)
+	assert.Equal(t, ErrUnreachable, errors.Cause(err), "Connection error should be reported as unreachable")
+}
+
+func TestAuth_Token_Deadline(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	// auth server never answers before test ends
+	release := make(chan struct{})
+	blocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer blocking.Close()
+	defer close(release)
+	a, _ := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry: registry,
+		Url:      blocking.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	})
+
+	reqCtx, reqCancel := context.WithTimeout(ctx, time.Millisecond*20)
+	defer reqCancel()
+	start := time.Now()
+	_, err := a.Token(reqCtx)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err), "Deadline error should be returned")
+	assert.True(t, time.Since(start) < time.Millisecond*50, "Token should return on deadline")
+}
+
 func TestResourceOwner_WrongUrlError(t *testing.T) {
 	ctx, cancel := clear()
 	defer cancel()
 	statusChanges := make([]bool, 0)
-	WatchGlobalReady(func(status bool) {
+	registry.Watch(func(status bool) {
 		statusChanges = append(statusChanges, status)
 	})
 
 	// first request will fail
-	respCode = http.StatusInternalServerError
-	reqCount = 0
+	respCode.Store(http.StatusInternalServerError)
+	reqCount.Store(0)
 
 	clientID := "koala-clientID"
 	secret := "koala-secret"
@@ -245,6 +463,7 @@ func TestResourceOwner_WrongUrlError(t *testing.T) {
 	//		[]byte(clientID+":"+secret),
 	//	)
 	a, err := ResourceOwner(ctx, ResourceOwnerOptions{
+		Registry: registry,
 		Url:      "wrong-url",
 		Username: "koala",
 		Password: "pass",
@@ -268,17 +487,18 @@ func TestResourceOwner_500(t *testing.T) {
 	ctx, cancel := clear()
 	defer cancel()
 	statusChanges := make([]bool, 0)
-	WatchGlobalReady(func(status bool) {
+	registry.Watch(func(status bool) {
 		statusChanges = append(statusChanges, status)
 	})
 
 	// first request will fail
-	blockResponse = http.StatusInternalServerError
+	blockResponse.Store(http.StatusInternalServerError)
 
 	clientID := "koala-clientID"
 	secret := "koala-secret"
 
 	a, err := ResourceOwner(ctx, ResourceOwnerOptions{
+		Registry: registry,
 		Url:      ts.URL,
 		Username: "koala",
 		Password: "pass",
@@ -293,7 +513,7 @@ func TestResourceOwner_500(t *testing.T) {
 	case <-time.After(time.Millisecond * 50):
 	}
 
-	assert.Truef(t, reqCount > 2, "Should retry, requests done: %d", reqCount)
+	assert.Truef(t, reqCount.Load() > 2, "Should retry, requests done: %d", reqCount.Load())
 }
 func TestResourceOwner_RetriesCount(t *testing.T) {
 	//<-time.After(time.Millisecond * 100)
@@ -301,13 +521,14 @@ func TestResourceOwner_RetriesCount(t *testing.T) {
 	defer cancel()
 
 	// first request will fail
-	blockResponse = http.StatusBadRequest
+	blockResponse.Store(http.StatusBadRequest)
 	maxRetries = 3
 
 	clientID := "koala-clientID"
 	secret := "koala-secret"
 
 	a, err := ResourceOwner(ctx, ResourceOwnerOptions{
+		Registry: registry,
 		Url:      ts.URL,
 		Username: "koala",
 		Password: "pass",
@@ -322,7 +543,7 @@ func TestResourceOwner_RetriesCount(t *testing.T) {
 		assert.Failf(t, "Token should not be returned", token)
 	case <-time.After(time.Millisecond * 100):
 	}
-	assert.Equal(t, a.maxRetries, uint(reqCount-1), "Incorrect number of retries")
+	assert.Equal(t, a.maxRetries, uint(reqCount.Load()-1), "Incorrect number of retries")
 	retryWait.SetBaseDuration(1)
 }
 
@@ -334,6 +555,7 @@ func TestResourceOwner_JSONError(t *testing.T) {
 	secret := "koala-secret"
 
 	a, err := ResourceOwner(ctx, ResourceOwnerOptions{
+		Registry: registry,
 		Url:      ts.URL,
 		Username: "koala",
 		Password: "pass",
@@ -343,13 +565,314 @@ func TestResourceOwner_JSONError(t *testing.T) {
 	assert.Nil(t, err, "Should not return error if all options are set")
 
 	a.retryMultiplier = 1e-5
-	nextBody = `{"":"koala",`
+	nextBody.Store(`{"":"koala",`)
 	select {
 	case token := <-a.GetToken():
 		assert.Failf(t, "Token should not be returned", token)
 	case <-time.After(time.Millisecond * 20):
 	}
-	assert.Truef(t, reqCount > 1, "Should retry on JSON error, got %d requests", reqCount)
+	assert.Truef(t, reqCount.Load() > 1, "Should retry on JSON error, got %d requests", reqCount.Load())
 
 	//assert.Fail(t, "-- to see output")
 }
+
+func TestAuth_RefreshToken(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+
+	a, err := ResourceOwner(ctx, ResourceOwnerOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		Username: "koala",
+		Password: "pass",
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	})
+	assert.Nil(t, err, "Should not return error if all options are set")
+
+	nextBody.Store(`{"access_token": "a1", "refresh_token": "r1"}`)
+	select {
+	case token := <-a.GetToken():
+		assert.Equal(t, "a1", token, "Supplied token doesn't match send token")
+	case <-time.After(time.Millisecond * 50):
+		assert.Fail(t, "Token not received")
+	}
+
+	// refresh token should be used instead of password
+	nextBody.Store(`{"access_token": "a2"}`)
+	a.Refresh()
+	select {
+	case token := <-a.GetToken():
+		assert.Equal(t, "a2", token, "Supplied token doesn't match send token")
+	case <-time.After(time.Millisecond * 50):
+		assert.Fail(t, "Token not received")
+	}
+	assert.Equal(t, TypeRefreshToken, lastQuery.Load().Get("grant_type"), "Refresh token grant should be used")
+	assert.Equal(t, "r1", lastQuery.Load().Get("refresh_token"), "Received incorrect refresh token")
+	assert.Empty(t, lastQuery.Load().Get("password"), "Password should not be sent with refresh grant")
+	assert.Equal(t, "r1", refreshToken(a), "Refresh token should be kept if not renewed")
+
+	// rejected refresh token falls back to original grant
+	rejectRefresh.Store(true)
+	grants.Store(nil)
+	nextBody.Store(`{"access_token": "a3"}`)
+	a.Refresh()
+	select {
+	case token := <-a.GetToken():
+		assert.Equal(t, "a3", token, "Supplied token doesn't match send token")
+	case <-time.After(time.Millisecond * 50):
+		assert.Fail(t, "Token not received")
+	}
+	assert.Equal(t, []string{TypeRefreshToken, TypeResourceOwner}, grants.Load(), "Should fall back to password grant")
+	assert.Equal(t, "koala", lastQuery.Load().Get("username"), "Received incorrect username")
+	assert.Empty(t, refreshToken(a), "Rejected refresh token should be dropped")
+}
+
+func refreshToken(a *Auth) string {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	return a.tokens.RefreshToken
+}
+
+// events of auth and ready state changes of its registry, so tests
+// wait for renewal instead of sleeping
+func watchAuth(a *Auth) (<-chan Event, <-chan bool) {
+	events := make(chan Event, 100)
+	a.SetEventHook(func(e Event) {
+		events <- e
+	})
+	ready := make(chan bool, 100)
+	registry.Watch(func(status bool) {
+		ready <- status
+	})
+	<-ready
+	return events, ready
+}
+
+// waits for event of given type, other events are skipped
+func waitEvent(t *testing.T, events <-chan Event, typ EventType) bool {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ {
+				return true
+			}
+		case <-timeout:
+			assert.Fail(t, "Event not received", typ)
+			return false
+		}
+	}
+}
+
+func TestAuth_ProactiveRenewal(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+
+	a, err := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry:    registry,
+		Url:         ts.URL,
+		ClientID:    "koala-clientID",
+		Secret:      "koala-secret",
+		RenewBefore: 900 * time.Millisecond,
+	})
+	assert.Nil(t, err, "Should not return error if all options are set")
+	events, ready := watchAuth(a)
+
+	nextBody.Store(`{"access_token": "a1", "expires_in": 1}`)
+	token, err := a.Token(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "a1", token, "Supplied token doesn't match send token")
+	waitEvent(t, events, EventTokenAcquired)
+	assert.True(t, <-ready, "Token should be valid")
+
+	// renewal happens in background, token stays valid whole time
+	nextBody.Store(`{"access_token": "a2", "expires_in": 60}`)
+	waitEvent(t, events, EventRefreshStarted)
+	waitEvent(t, events, EventTokenAcquired)
+	token, _ = a.Token(ctx)
+	assert.Equal(t, "a2", token, "Token should be renewed before expiry")
+	assert.Equal(t, 2, reqCount.Load(), "Renewal should be done once")
+	assert.Empty(t, ready, "Token should stay valid during renewal")
+
+	// no renewal after context is closed
+	nextBody.Store(`{"access_token": "a3", "expires_in": 1}`)
+	a.Refresh()
+	waitEvent(t, events, EventTokenAcquired)
+	cancel()
+	select {
+	case e := <-events:
+		assert.Fail(t, "Renewal should stop when context is closed", e.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestAuth_RenewalFailure(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+
+	a, err := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry:    registry,
+		Url:         ts.URL,
+		ClientID:    "koala-clientID",
+		Secret:      "koala-secret",
+		RenewBefore: 900 * time.Millisecond,
+	})
+	assert.Nil(t, err, "Should not return error if all options are set")
+	events, ready := watchAuth(a)
+
+	nextBody.Store(`{"access_token": "a1", "expires_in": 1}`)
+	blockResponse.Store(0)
+	token, err := a.Token(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "a1", token, "Supplied token doesn't match send token")
+	waitEvent(t, events, EventTokenAcquired)
+	assert.True(t, <-ready, "Token should be valid")
+
+	// renewal fails, token is still valid until it expires
+	blockResponse.Store(http.StatusServiceUnavailable)
+	waitEvent(t, events, EventGivenUp)
+	assert.Empty(t, ready, "Token should stay valid until it expires")
+	waitEvent(t, events, EventRefreshStarted)
+
+	select {
+	case status := <-ready:
+		assert.False(t, status, "Expired token should not be valid")
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Token should expire")
+	}
+
+	blockResponse.Store(0)
+	nextBody.Store(`{"access_token": "a2", "expires_in": 60}`)
+	token, err = a.Token(ctx)
+	if err != nil {
+		// renewal started before server recovered, next call starts new chain
+		token, err = a.Token(ctx)
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, "a2", token, "New token should be fetched after expiry")
+}
+
+func TestClientCredentials_ClientSecretPost(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	a, err := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry:   registry,
+		Url:        ts.URL,
+		ClientID:   "koala-clientID",
+		Secret:     "koala-secret",
+		ClientAuth: ClientAuthPost,
+	})
+	assert.Nil(t, err, "Should not return error if all options are set")
+
+	_, err = a.Token(ctx)
+	assert.Nil(t, err, "Should not return error if token was fetched")
+	assert.Equal(t, "koala-clientID", lastQuery.Load().Get("client_id"), "Client ID should be sent in body")
+	assert.Equal(t, "koala-secret", lastQuery.Load().Get("client_secret"), "Secret should be sent in body")
+	assert.Empty(t, lastHeaders.Load().Get("authorization"), "Basic header should not be sent")
+
+	_, err = ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry:   registry,
+		Url:        ts.URL,
+		ClientID:   "koala-clientID",
+		Secret:     "koala-secret",
+		ClientAuth: "koala",
+	})
+	assert.NotNil(t, err, "Unknown client authentication should be rejected")
+}
+
+func TestPrivateKeyJWT(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+
+	der, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	file, _ := ioutil.TempFile("", "key")
+	defer os.Remove(file.Name())
+	_ = pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	_ = file.Close()
+
+	a, err := PrivateKeyJWT(ctx, PrivateKeyJWTOptions{
+		Registry:       registry,
+		Url:            ts.URL,
+		ClientID:       "koala-clientID",
+		PrivateKeyFile: file.Name(),
+		KeyID:          "ec1",
+	})
+	assert.Nil(t, err, "Should not return error if all options are set")
+
+	_, err = a.Token(ctx)
+	assert.Nil(t, err, "Should not return error if token was fetched")
+	assert.Equal(t, TypeClientCredentials, lastQuery.Load().Get("grant_type"), "Received incorrect grant type")
+	assert.Equal(t, clientAssertionType, lastQuery.Load().Get("client_assertion_type"), "Received incorrect assertion type")
+	assert.Empty(t, lastHeaders.Load().Get("authorization"), "Basic header should not be sent")
+
+	assertion, err := parseJWT(lastQuery.Load().Get("client_assertion"))
+	assert.Nil(t, err, "Assertion should be a valid JWT")
+	if err != nil {
+		return
+	}
+	assert.Nil(t, assertion.verify(&ecKey.PublicKey), "Assertion should be signed with private key")
+	assert.Equal(t, "ES256", assertion.header.Alg, "Incorrect algorithm")
+	assert.Equal(t, "ec1", assertion.header.Kid, "Incorrect key ID")
+	assert.Equal(t, "koala-clientID", assertion.claims.String("iss"), "Incorrect issuer")
+	assert.Equal(t, "koala-clientID", assertion.claims.Subject(), "Incorrect subject")
+	assert.Equal(t, []string{ts.URL}, assertion.claims.Audience(), "Token url should be the audience")
+	assert.NotEmpty(t, assertion.claims.String("jti"), "Assertion should have unique ID")
+	assert.Nil(t, assertion.claims.validTime(time.Now(), 0), "Assertion should not be expired")
+
+	_, err = PrivateKeyJWT(ctx, PrivateKeyJWTOptions{
+		Registry:   registry,
+		Url:        ts.URL,
+		ClientID:   "koala-clientID",
+		PrivateKey: "koala",
+	})
+	assert.NotNil(t, err, "Invalid key should be rejected")
+}
+
+func TestJWTBearer(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+
+	a, err := JWTBearer(ctx, JWTBearerOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Subject:  "koala@zoo",
+		Audience: "https://zoo",
+		Key:      rsaKey,
+	})
+	assert.Nil(t, err, "Should not return error if all options are set")
+
+	_, err = a.Token(ctx)
+	assert.Nil(t, err, "Should not return error if token was fetched")
+	assert.Equal(t, TypeJWTBearer, lastQuery.Load().Get("grant_type"), "Received incorrect grant type")
+	assert.Equal(t, "koala-clientID", lastQuery.Load().Get("client_id"), "Client ID should be sent without secret")
+	assert.Empty(t, lastHeaders.Load().Get("authorization"), "Basic header should not be sent without secret")
+
+	assertion, err := parseJWT(lastQuery.Load().Get("assertion"))
+	assert.Nil(t, err, "Assertion should be a valid JWT")
+	if err != nil {
+		return
+	}
+	assert.Nil(t, assertion.verify(&rsaKey.PublicKey), "Assertion should be signed with private key")
+	assert.Equal(t, "RS256", assertion.header.Alg, "Incorrect algorithm")
+	assert.Equal(t, "koala-clientID", assertion.claims.String("iss"), "Client ID should be default issuer")
+	assert.Equal(t, "koala@zoo", assertion.claims.Subject(), "Incorrect subject")
+	assert.Equal(t, []string{"https://zoo"}, assertion.claims.Audience(), "Incorrect audience")
+
+	// with secret client is authenticated
+	a, _ = JWTBearer(ctx, JWTBearerOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+		Subject:  "koala@zoo",
+		Key:      rsaKey,
+	})
+	_, err = a.Token(ctx)
+	assert.Nil(t, err, "Should not return error if token was fetched")
+	assert.NotEmpty(t, lastHeaders.Load().Get("authorization"), "Basic header should be sent with secret")
+
+	_, err = JWTBearer(ctx, JWTBearerOptions{Url: ts.URL, ClientID: "koala-clientID", Key: rsaKey, Registry: registry})
+	assert.NotNil(t, err, "Missing subject should be rejected")
+}
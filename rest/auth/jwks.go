@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// keySet - cached JWKS document, refetched when unknown key id is requested
+	keySet struct {
+		url        string
+		client     *http.Client
+		minRefresh time.Duration
+
+		m          sync.RWMutex
+		refreshing sync.Mutex
+		keys       map[string]crypto.PublicKey
+		// failed refreshes count too, so unknown key ids can't flood JWKS endpoint
+		lastRefresh time.Time
+	}
+
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+)
+
+// ErrUnknownKey - token key id was not found in JWKS document
+var ErrUnknownKey = errors.New("rest/auth: unknown signing key")
+
+func newKeySet(url string, client *http.Client, minRefresh time.Duration) *keySet {
+	return &keySet{
+		url:        url,
+		client:     client,
+		minRefresh: minRefresh,
+		keys:       make(map[string]crypto.PublicKey),
+	}
+}
+
+// Returns key with given id. If key is not cached JWKS document is refetched,
+// but not more often than minRefresh.
+func (ks *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if key, ok := ks.cached(kid); ok {
+		return key, nil
+	}
+
+	ks.refreshing.Lock()
+	defer ks.refreshing.Unlock()
+	// could be refreshed while waiting for lock
+	if key, ok := ks.cached(kid); ok {
+		return key, nil
+	}
+	ks.m.RLock()
+	recent := !ks.lastRefresh.IsZero() && time.Since(ks.lastRefresh) < ks.minRefresh
+	ks.m.RUnlock()
+	if recent {
+		return nil, errors.Wrapf(ErrUnknownKey, "key '%s' not found", kid)
+	}
+
+	err := ks.refresh(ctx)
+	ks.m.Lock()
+	ks.lastRefresh = time.Now()
+	ks.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := ks.cached(kid); ok {
+		return key, nil
+	}
+	return nil, errors.Wrapf(ErrUnknownKey, "key '%s' not found", kid)
+}
+
+// Key lookup. Empty kid matches the only key in the set.
+func (ks *keySet) cached(kid string) (crypto.PublicKey, bool) {
+	ks.m.RLock()
+	defer ks.m.RUnlock()
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+func (ks *keySet) refresh(ctx context.Context) error {
+	req, err := http.NewRequest("GET", ks.url, nil)
+	if err != nil {
+		return errors.Wrap(err, "keySet.refresh: error creating request")
+	}
+	resp, err := ks.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(ErrUnreachable, "keySet.refresh: error fetching JWKS: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Wrapf(ErrUnreachable, "keySet.refresh: error fetching JWKS. Code: %d", resp.StatusCode)
+	}
+
+	doc := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	if err != nil {
+		return errors.Wrap(err, "keySet.refresh: error decoding JWKS")
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		// skip encryption keys and key types we don't support
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	ks.m.Lock()
+	ks.keys = keys
+	ks.m.Unlock()
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
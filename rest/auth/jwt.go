@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // hash implementations used by supported algorithms
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+type (
+	// Claims - decoded JWT payload
+	Claims map[string]interface{}
+
+	jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		Typ string `json:"typ"`
+	}
+
+	jwtToken struct {
+		header    jwtHeader
+		claims    Claims
+		signed    []byte
+		signature []byte
+	}
+)
+
+var (
+	// ErrInvalidToken - token is malformed or its signature doesn't match
+	ErrInvalidToken = errors.New("rest/auth: invalid token")
+	// ErrTokenExpired - token exp or nbf claims are not satisfied
+	ErrTokenExpired = errors.New("rest/auth: token expired or not yet valid")
+	// ErrInvalidClaims - token iss or aud claims don't match expected values
+	ErrInvalidClaims = errors.New("rest/auth: invalid token claims")
+)
+
+var algHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// Splits and decodes compact serialised JWT. Signature is not verified.
+func parseJWT(raw string) (*jwtToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.Wrap(ErrInvalidToken, "token should have 3 parts")
+	}
+
+	t := &jwtToken{signed: []byte(parts[0] + "." + parts[1])}
+	if err := decodeSegment(parts[0], &t.header); err != nil {
+		return nil, errors.Wrapf(ErrInvalidToken, "error decoding header: %s", err)
+	}
+	if err := decodeSegment(parts[1], &t.claims); err != nil {
+		return nil, errors.Wrapf(ErrInvalidToken, "error decoding claims: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidToken, "error decoding signature: %s", err)
+	}
+	t.signature = sig
+	return t, nil
+}
+
+func decodeSegment(segment string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Verifies token signature with the public key
+func (t *jwtToken) verify(key crypto.PublicKey) error {
+	hash, ok := algHashes[t.header.Alg]
+	if !ok {
+		return errors.Wrapf(ErrInvalidToken, "unsupported algorithm '%s'", t.header.Alg)
+	}
+	h := hash.New()
+	_, _ = h.Write(t.signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch t.header.Alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, hash, digest, t.signature)
+		case "PS":
+			err = rsa.VerifyPSS(k, hash, digest, t.signature,
+				&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			err = errors.Errorf("algorithm '%s' doesn't match RSA key", t.header.Alg)
+		}
+		if err != nil {
+			return errors.Wrapf(ErrInvalidToken, "signature verification failed: %s", err)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if t.header.Alg[:2] != "ES" || len(t.signature) != 2*size {
+			return errors.Wrap(ErrInvalidToken, "signature doesn't match EC key")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.Wrap(ErrInvalidToken, "signature verification failed")
+		}
+	default:
+		return errors.Wrapf(ErrInvalidToken, "unsupported key type %T", key)
+	}
+	return nil
+}
+
+// Creates compact serialised JWT signed with the private key.
+// Supports RSA PKCS1v15 and ECDSA keys, key type has to match alg.
+func signJWT(alg, kid string, key crypto.Signer, claims Claims) (string, error) {
+	hash, ok := algHashes[alg]
+	if !ok {
+		return "", errors.Errorf("unsupported algorithm '%s'", alg)
+	}
+	header, err := json.Marshal(jwtHeader{Alg: alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	h := hash.New()
+	_, _ = h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return "", errors.Errorf("algorithm '%s' doesn't match RSA key", alg)
+		}
+		sig, err = key.Sign(rand.Reader, digest, hash)
+		if err != nil {
+			return "", err
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return "", errors.Errorf("algorithm '%s' doesn't match EC key", alg)
+		}
+		der, err := key.Sign(rand.Reader, digest, hash)
+		if err != nil {
+			return "", err
+		}
+		// JWS uses fixed size r||s instead of ASN.1
+		rs := struct{ R, S *big.Int }{}
+		if _, err = asn1.Unmarshal(der, &rs); err != nil {
+			return "", err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r, s := rs.R.Bytes(), rs.S.Bytes()
+		copy(sig[size-len(r):size], r)
+		copy(sig[2*size-len(s):], s)
+	default:
+		return "", errors.Errorf("unsupported key type %T", k)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Checks time based claims. exp is required, nbf is optional.
+func (c Claims) validTime(now time.Time, leeway time.Duration) error {
+	exp, ok := c.Time("exp")
+	if !ok {
+		return errors.Wrap(ErrTokenExpired, "missing exp claim")
+	}
+	if now.After(exp.Add(leeway)) {
+		return errors.Wrapf(ErrTokenExpired, "token expired at %s", exp.Format(time.RFC3339))
+	}
+	if nbf, ok := c.Time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return errors.Wrapf(ErrTokenExpired, "token not valid before %s", nbf.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// String - returns claim value if it is a string
+func (c Claims) String(key string) string {
+	s, _ := c[key].(string)
+	return s
+}
+
+// Strings - returns claim value that can be either a single string or an array of strings
+func (c Claims) Strings(key string) []string {
+	switch v := c[key].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Time - returns NumericDate claim value as time
+func (c Claims) Time(key string) (time.Time, bool) {
+	v, ok := c[key].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec := int64(v)
+	nsec := int64((v - float64(sec)) * 1e9)
+	return time.Unix(sec, nsec), true
+}
+
+// Subject - returns sub claim
+func (c Claims) Subject() string {
+	return c.String("sub")
+}
+
+// Audience - returns aud claim, which can be either a string or an array
+func (c Claims) Audience() []string {
+	return c.Strings("aud")
+}
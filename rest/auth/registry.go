@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"github.com/hop-city/common/readiness"
+	"sync"
+)
+
+type (
+	// Registry - set of Auth instances with combined ready state.
+	// Registry is ready when all of its instances hold valid tokens.
+	Registry struct {
+		m sync.Mutex
+		// held while state change is delivered, so watchers get changes in order
+		notifying sync.Mutex
+
+		key       string
+		auths     []*Auth
+		callbacks []func(bool)
+		ready     bool
+	}
+)
+
+var defaultRegistry struct {
+	once     sync.Once
+	registry *Registry
+}
+
+// DefaultRegistry - Auth instances created without Registry option are registered here.
+// Its state is reported with readiness under "auth" key.
+func DefaultRegistry() *Registry {
+	defaultRegistry.once.Do(func() {
+		defaultRegistry.registry = NewRegistry("auth")
+	})
+	return defaultRegistry.registry
+}
+
+// NewRegistry - creates empty registry. If readinessKey is not empty
+// registry state is reported with readiness.Set under that key.
+func NewRegistry(readinessKey string) *Registry {
+	r := &Registry{
+		key:       readinessKey,
+		auths:     make([]*Auth, 0),
+		callbacks: make([]func(bool), 0),
+		ready:     true,
+	}
+	if r.key != "" {
+		readiness.Set(r.key, true)
+	}
+	return r
+}
+
+// Register - adds Auth to registry, removing it from previous one.
+// Auth is unregistered automatically when its ctx is closed.
+func (r *Registry) Register(a *Auth) {
+	a.m.Lock()
+	previous := a.registry
+	a.registry = r
+	a.m.Unlock()
+	if previous == r {
+		return
+	}
+	if previous != nil {
+		previous.remove(a)
+	}
+
+	r.m.Lock()
+	r.auths = append(r.auths, a)
+	r.m.Unlock()
+	r.notify()
+}
+
+// Unregister - removes Auth from registry
+func (r *Registry) Unregister(a *Auth) {
+	a.m.Lock()
+	if a.registry == r {
+		a.registry = nil
+	}
+	a.m.Unlock()
+	r.remove(a)
+}
+
+// IsReady - true if all registered instances hold valid tokens
+func (r *Registry) IsReady() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.status()
+}
+
+// Watch - callback is called with current state and then on every state change.
+// Callbacks are called one at a time, so they must not change registry state.
+func (r *Registry) Watch(callback func(bool)) {
+	r.notifying.Lock()
+	defer r.notifying.Unlock()
+	r.m.Lock()
+	r.callbacks = append(r.callbacks, callback)
+	ready := r.status()
+	r.m.Unlock()
+	callback(ready)
+}
+
+func (r *Registry) remove(a *Auth) {
+	r.m.Lock()
+	for i, v := range r.auths {
+		if v == a {
+			r.auths = append(r.auths[:i], r.auths[i+1:]...)
+			break
+		}
+	}
+	r.m.Unlock()
+	r.notify()
+}
+
+// Informs watchers and readiness about state change
+func (r *Registry) notify() {
+	r.notifying.Lock()
+	defer r.notifying.Unlock()
+	r.m.Lock()
+	ready := r.status()
+	if ready == r.ready {
+		r.m.Unlock()
+		return
+	}
+	r.ready = ready
+	callbacks := append([]func(bool){}, r.callbacks...)
+	r.m.Unlock()
+
+	if r.key != "" {
+		readiness.Set(r.key, ready)
+	}
+	for _, callback := range callbacks {
+		callback(ready)
+	}
+}
+
+// has to be called with lock held
+func (r *Registry) status() bool {
+	ready := true
+	for _, a := range r.auths {
+		ready = ready && a.valid.Load().(bool)
+	}
+	return ready
+}
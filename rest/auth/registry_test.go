@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"github.com/hop-city/common/readiness"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	options := ClientCredentialsOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	}
+
+	r := NewRegistry("")
+	assert.True(t, r.IsReady(), "Empty registry should be ready")
+	statusChanges := make([]bool, 0)
+	r.Watch(func(status bool) {
+		statusChanges = append(statusChanges, status)
+	})
+
+	a, _ := ClientCredentials(ctx, options)
+	assert.Equal(t, 1, len(registry.auths), "Auth should be added to registry from options")
+	r.Register(a)
+	assert.Equal(t, 0, len(registry.auths), "Auth should be moved from previous registry")
+	assert.False(t, r.IsReady(), "Registry with invalid auth should not be ready")
+
+	_, _ = a.Token(ctx)
+	assert.True(t, r.IsReady(), "Registry should be ready after token was fetched")
+
+	a2, _ := ClientCredentials(ctx, options)
+	r.Register(a2)
+	assert.False(t, r.IsReady(), "New auth should make registry not ready")
+	r.Unregister(a2)
+	assert.True(t, r.IsReady(), "Unregistered auth should not affect registry")
+	assert.Equal(t, []bool{true, false, true, false, true}, statusChanges, "Watcher should receive every change")
+}
+
+// watchers have to see state changes in the same order as they happened
+func TestRegistry_WatchOrder(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+	options := ClientCredentialsOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	}
+
+	auths := make([]*Auth, 4)
+	for i := range auths {
+		auths[i], _ = ClientCredentials(ctx, options)
+	}
+	var m sync.Mutex
+	statusChanges := make([]bool, 0)
+	registry.Watch(func(status bool) {
+		// gives other notifications a chance to overtake this one
+		time.Sleep(time.Microsecond)
+		m.Lock()
+		statusChanges = append(statusChanges, status)
+		m.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for _, a := range auths {
+		wg.Add(1)
+		go func(a *Auth) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				a.setValid(i%2 == 0)
+			}
+		}(a)
+	}
+	wg.Wait()
+
+	m.Lock()
+	defer m.Unlock()
+	for i := 1; i < len(statusChanges); i++ {
+		if !assert.NotEqual(t, statusChanges[i-1], statusChanges[i], "Watcher should receive only changes") {
+			break
+		}
+	}
+	assert.Equal(t, registry.IsReady(), statusChanges[len(statusChanges)-1], "Last change should match registry state")
+}
+
+func TestRegistry_Readiness(t *testing.T) {
+	ctx, cancel := clear()
+	defer cancel()
+
+	r := NewRegistry("auth-registry-test")
+	blockResponse.Store(http.StatusServiceUnavailable)
+	a, _ := ClientCredentials(ctx, ClientCredentialsOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	})
+	r.Register(a)
+	assert.False(t, readiness.IsReady(), "Readiness should be set when auth is not valid")
+
+	blockResponse.Store(0)
+	a.Refresh()
+	<-time.After(time.Millisecond * 20)
+	assert.True(t, a.valid.Load().(bool), "Token should be fetched")
+	assert.True(t, readiness.IsReady(), "Readiness should be set when auth is valid")
+
+	// instances are removed when their ctx is closed
+	authCtx, authCancel := clear()
+	blockResponse.Store(http.StatusServiceUnavailable)
+	a2, _ := ClientCredentials(authCtx, ClientCredentialsOptions{
+		Registry: registry,
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	})
+	r.Register(a2)
+	assert.False(t, readiness.IsReady(), "New invalid auth should make service not ready")
+	authCancel()
+	<-time.After(time.Millisecond * 5)
+	assert.Equal(t, 1, len(r.auths), "Auth should be unregistered when ctx is closed")
+	assert.True(t, readiness.IsReady(), "Closed auth should not affect readiness")
+}
+
+func TestRegistry_Default(t *testing.T) {
+	ctx, cancel := clear()
+
+	a, _ := ClientCredentials(ctx, ClientCredentialsOptions{
+		Url:      ts.URL,
+		ClientID: "koala-clientID",
+		Secret:   "koala-secret",
+	})
+	assert.Equal(t, DefaultRegistry(), a.registry, "Auth without registry option should use default registry")
+
+	assert.False(t, readiness.IsReady(), "Default registry should report under readiness")
+	_, _ = a.Token(ctx)
+	assert.True(t, DefaultRegistry().IsReady(), "Default registry should be ready after token was fetched")
+	assert.True(t, readiness.IsReady(), "Readiness should be set when default registry is ready")
+
+	cancel()
+	<-time.After(time.Millisecond * 5)
+	r := DefaultRegistry()
+	r.m.Lock()
+	defer r.m.Unlock()
+	assert.Equal(t, 0, len(r.auths), "Auth should be unregistered when ctx is closed")
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"github.com/hop-city/common/rest/server"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type (
+	ValidatorOptions struct {
+		JwksUrl string `env:"AUTH_JWKS_URL" long:"auth-jwks-url"`
+		// expected iss claim - not checked if empty
+		Issuer string `env:"AUTH_ISSUER" long:"auth-issuer"`
+		// expected aud claim - not checked if empty
+		Audience string `env:"AUTH_AUDIENCE" long:"auth-audience"`
+
+		// allowed clock skew when checking exp and nbf
+		Leeway time.Duration `env:"AUTH_LEEWAY" long:"auth-leeway"`
+		// minimal time between JWKS refetches on unknown key id - 1 minute by default
+		JwksMinRefresh time.Duration `env:"AUTH_JWKS_MIN_REFRESH" long:"auth-jwks-min-refresh"`
+	}
+
+	// Validator - validates incoming bearer JWTs against JWKS document
+	Validator struct {
+		ctx      context.Context
+		issuer   string
+		audience string
+		leeway   time.Duration
+		keys     *keySet
+		now      func() time.Time
+	}
+
+	// KeyError - token was rejected because its signing key could not be found.
+	// errors.Cause returns ErrInvalidToken, Err keeps the reason - ErrUnknownKey
+	// if JWKS document doesn't have the key, ErrUnreachable if it couldn't be fetched.
+	KeyError struct {
+		Err error
+	}
+
+	contextKey string
+)
+
+const claimsKey contextKey = "claims"
+const bearerKey contextKey = "bearer"
+
+// ErrMissingToken - request doesn't carry bearer token
+var ErrMissingToken = errors.New("rest/auth: missing bearer token")
+
+func NewValidator(ctx context.Context, options ValidatorOptions) (*Validator, error) {
+	if options.JwksUrl == "" {
+		return nil, errors.New("Auth.NewValidator: Missing JWKS url")
+	}
+	if options.JwksMinRefresh == 0 {
+		options.JwksMinRefresh = time.Minute
+	}
+
+	v := &Validator{
+		ctx:      ctx,
+		issuer:   options.Issuer,
+		audience: options.Audience,
+		leeway:   options.Leeway,
+		keys:     newKeySet(options.JwksUrl, httpClient(), options.JwksMinRefresh),
+		now:      time.Now,
+	}
+	return v, nil
+}
+
+// Validate - verifies token signature and claims, returns decoded claims
+func (v *Validator) Validate(raw string) (Claims, error) {
+	t, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := algHashes[t.header.Alg]; !ok {
+		return nil, errors.Wrapf(ErrInvalidToken, "unsupported algorithm '%s'", t.header.Alg)
+	}
+
+	// refresh is shared by all requests, so it is bound to validator ctx
+	key, err := v.keys.key(v.ctx, t.header.Kid)
+	if err != nil {
+		return nil, &KeyError{Err: err}
+	}
+	if err = t.verify(key); err != nil {
+		return nil, err
+	}
+
+	if err = t.claims.validTime(v.now(), v.leeway); err != nil {
+		return nil, err
+	}
+	if v.issuer != "" && t.claims.String("iss") != v.issuer {
+		return nil, errors.Wrapf(ErrInvalidClaims, "unexpected issuer '%s'", t.claims.String("iss"))
+	}
+	if v.audience != "" && !contains(t.claims.Audience(), v.audience) {
+		return nil, errors.Wrapf(ErrInvalidClaims, "audience '%s' not found", v.audience)
+	}
+	return t.claims, nil
+}
+
+func (e *KeyError) Error() string {
+	return ErrInvalidToken.Error() + ": " + e.Err.Error()
+}
+
+// Cause - ErrInvalidToken, so key errors are handled as other invalid tokens
+func (e *KeyError) Cause() error {
+	return ErrInvalidToken
+}
+
+// Unwrap - original key lookup error, see errors.Is and errors.As
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// Middleware - validates Authorization Bearer token and adds its claims to request context.
+// Invalid requests are rejected with 401.
+func (v *Validator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := zerolog.Ctx(r.Context())
+
+		raw := bearerToken(r)
+		if raw == "" {
+			w.Header().Set("www-authenticate", "Bearer")
+			_ = server.Respond(w, http.StatusUnauthorized, ErrMissingToken)
+			return
+		}
+
+		claims, err := v.Validate(raw)
+		if err != nil {
+			log.Debug().Err(err).Msg("Auth.Validator: token rejected")
+			w.Header().Set("www-authenticate", `Bearer error="invalid_token"`)
+			_ = server.Respond(w, http.StatusUnauthorized, errors.Cause(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
+		ctx = context.WithValue(ctx, bearerKey, raw)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetClaims - returns claims of validated token from context, nil if there are none
+func GetClaims(ctx context.Context) Claims {
+	claims, _ := ctx.Value(claimsKey).(Claims)
+	return claims
+}
+
+// GetBearerToken - returns raw validated token from context, empty if there is none
+func GetBearerToken(ctx context.Context) string {
+	token, _ := ctx.Value(bearerKey).(string)
+	return token
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
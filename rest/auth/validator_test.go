@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+var ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+type jwksServer struct {
+	ts       *httptest.Server
+	keys     []map[string]string
+	reqCount int32
+	status   int32
+}
+
+func newJwksServer() *jwksServer {
+	s := &jwksServer{}
+	s.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.reqCount, 1)
+		if status := atomic.LoadInt32(&s.status); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+	}))
+	return s
+}
+
+func rsaJwk(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJwk(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func signTestJWT(alg, kid string, key crypto.Signer, claims Claims) string {
+	token, _ := signJWT(alg, kid, key, claims)
+	return token
+}
+
+func testClaims() Claims {
+	return Claims{
+		"sub": "koala",
+		"iss": "https://issuer",
+		"aud": []string{"orders", "users"},
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func validatorSetup() (context.Context, func(), *jwksServer, *Validator) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newJwksServer()
+	s.keys = []map[string]string{rsaJwk("rsa1", &rsaKey.PublicKey), ecJwk("ec1", &ecKey.PublicKey)}
+	v, _ := NewValidator(ctx, ValidatorOptions{
+		JwksUrl:        s.ts.URL,
+		Issuer:         "https://issuer",
+		Audience:       "orders",
+		JwksMinRefresh: time.Millisecond,
+	})
+	return ctx, func() {
+		s.ts.Close()
+		cancel()
+	}, s, v
+}
+
+func TestNewValidator(t *testing.T) {
+	_, err := NewValidator(context.Background(), ValidatorOptions{})
+	assert.NotNil(t, err, "Should return error if JWKS url is missing")
+}
+
+func TestValidator_Validate(t *testing.T) {
+	_, cancel, s, v := validatorSetup()
+	defer cancel()
+
+	claims, err := v.Validate(signTestJWT("RS256", "rsa1", rsaKey, testClaims()))
+	assert.Nil(t, err, "Valid RSA token should be accepted")
+	assert.Equal(t, "koala", claims.Subject(), "Incorrect subject")
+	assert.Equal(t, []string{"orders", "users"}, claims.Audience(), "Incorrect audience")
+
+	_, err = v.Validate(signTestJWT("ES256", "ec1", ecKey, testClaims()))
+	assert.Nil(t, err, "Valid EC token should be accepted")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&s.reqCount), "JWKS should be fetched once and cached")
+
+	c := testClaims()
+	c["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = v.Validate(signTestJWT("RS256", "rsa1", rsaKey, c))
+	assert.Equal(t, ErrTokenExpired, errors.Cause(err), "Expired token should be rejected")
+
+	c = testClaims()
+	c["nbf"] = time.Now().Add(time.Minute).Unix()
+	_, err = v.Validate(signTestJWT("RS256", "rsa1", rsaKey, c))
+	assert.Equal(t, ErrTokenExpired, errors.Cause(err), "Token used before nbf should be rejected")
+
+	c = testClaims()
+	c["iss"] = "https://other"
+	_, err = v.Validate(signTestJWT("RS256", "rsa1", rsaKey, c))
+	assert.Equal(t, ErrInvalidClaims, errors.Cause(err), "Token from other issuer should be rejected")
+
+	c = testClaims()
+	c["aud"] = "payments"
+	_, err = v.Validate(signTestJWT("RS256", "rsa1", rsaKey, c))
+	assert.Equal(t, ErrInvalidClaims, errors.Cause(err), "Token for other audience should be rejected")
+
+	// signed with EC key but claims to be RSA one
+	_, err = v.Validate(signTestJWT("ES256", "rsa1", ecKey, testClaims()))
+	assert.Equal(t, ErrInvalidToken, errors.Cause(err), "Token with invalid signature should be rejected")
+
+	raw := signTestJWT("RS256", "rsa1", rsaKey, testClaims())
+	parts := strings.Split(raw, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa1"}`))
+	_, err = v.Validate(none + "." + parts[1] + ".")
+	assert.Equal(t, ErrInvalidToken, errors.Cause(err), "Unsigned token should be rejected")
+
+	_, err = v.Validate("koala")
+	assert.Equal(t, ErrInvalidToken, errors.Cause(err), "Malformed token should be rejected")
+}
+
+func TestValidator_KeyRotation(t *testing.T) {
+	_, cancel, s, v := validatorSetup()
+	defer cancel()
+
+	_, err := v.Validate(signTestJWT("RS256", "rsa1", rsaKey, testClaims()))
+	assert.Nil(t, err, "Valid token should be accepted")
+
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	s.keys = []map[string]string{rsaJwk("rsa2", &newKey.PublicKey)}
+	<-time.After(time.Millisecond * 2)
+
+	_, err = v.Validate(signTestJWT("RS256", "rsa2", newKey, testClaims()))
+	assert.Nil(t, err, "Token signed with rotated key should be accepted")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&s.reqCount), "JWKS should be refetched on unknown key")
+
+	_, err = v.Validate(signTestJWT("RS256", "rsa1", rsaKey, testClaims()))
+	assert.Equal(t, ErrInvalidToken, errors.Cause(err), "Token signed with removed key should be rejected")
+}
+
+func TestValidator_KeyError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newJwksServer()
+	defer s.ts.Close()
+	s.keys = []map[string]string{rsaJwk("rsa1", &rsaKey.PublicKey)}
+	v, _ := NewValidator(ctx, ValidatorOptions{JwksUrl: s.ts.URL, JwksMinRefresh: time.Minute})
+
+	_, err := v.Validate(signTestJWT("RS256", "rsa2", rsaKey, testClaims()))
+	assert.Equal(t, ErrInvalidToken, errors.Cause(err), "Token with unknown key should be invalid")
+	assert.True(t, errors.Is(err, ErrUnknownKey), "Unknown key should be kept as reason")
+
+	// JWKS endpoint down - failed refresh is throttled as well
+	v, _ = NewValidator(ctx, ValidatorOptions{JwksUrl: s.ts.URL, JwksMinRefresh: time.Minute})
+	atomic.StoreInt32(&s.status, http.StatusServiceUnavailable)
+	atomic.StoreInt32(&s.reqCount, 0)
+	_, err = v.Validate(signTestJWT("RS256", "rsa1", rsaKey, testClaims()))
+	assert.Equal(t, ErrInvalidToken, errors.Cause(err), "Token should be invalid when JWKS is unreachable")
+	assert.True(t, errors.Is(err, ErrUnreachable), "Unreachable JWKS should be kept as reason")
+	var keyErr *KeyError
+	assert.True(t, errors.As(err, &keyErr), "KeyError should be returned")
+	for i := 0; i < 3; i++ {
+		_, _ = v.Validate(signTestJWT("RS256", "rsa3", rsaKey, testClaims()))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&s.reqCount), "Failed refresh should not be repeated before minRefresh")
+}
+
+func TestValidator_Middleware(t *testing.T) {
+	_, cancel, _, v := validatorSetup()
+	defer cancel()
+
+	var claims Claims
+	var bearer string
+	ts := httptest.NewServer(v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims = GetClaims(r.Context())
+		bearer = GetBearerToken(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})))
+	defer ts.Close()
+
+	get := func(header string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		if header != "" {
+			req.Header.Set("authorization", header)
+		}
+		resp, _ := http.DefaultClient.Do(req)
+		return resp
+	}
+
+	token := signTestJWT("RS256", "rsa1", rsaKey, testClaims())
+	resp := get("Bearer " + token)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Valid token should pass")
+	assert.Equal(t, "koala", claims.Subject(), "Claims should be added to context")
+	assert.Equal(t, token, bearer, "Token should be added to context")
+
+	resp = get("")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Missing token should be rejected")
+	assert.Equal(t, "Bearer", resp.Header.Get("www-authenticate"), "Challenge should be returned")
+
+	c := testClaims()
+	c["exp"] = time.Now().Add(-time.Minute).Unix()
+	resp = get("Bearer " + signTestJWT("RS256", "rsa1", rsaKey, c))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Expired token should be rejected")
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, ErrTokenExpired.Error(), string(b), "Rejection reason should be returned")
+}
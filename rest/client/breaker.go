@@ -0,0 +1,245 @@
+package client
+
+import (
+	"fmt"
+	"github.com/hop-city/common/readiness"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	BreakerState string
+
+	// BreakerOptions - zero values are replaced with defaults
+	BreakerOptions struct {
+		// open after that many failures in a row - 5 by default
+		ConsecutiveFailures uint
+		// open when failure ratio within Window reaches value, 0 - disabled
+		FailureRatio float64
+		// minimal number of requests within Window to check ratio - 10 by default
+		MinRequests uint
+		// period of counting requests for ratio - 1 minute by default
+		Window time.Duration
+		// how long circuit stays open before trial requests are let through - 30s by default
+		Cooldown time.Duration
+		// number of trial requests in half-open state - 1 by default
+		HalfOpenRequests uint
+	}
+
+	// Breaker - circuit breaker keeping separate circuit for each upstream host
+	Breaker struct {
+		m         sync.Mutex
+		options   BreakerOptions
+		circuits  map[string]*circuit
+		callbacks []func(host string, state BreakerState)
+	}
+
+	// CircuitOpenError - returned by Fetch without sending request while circuit is open
+	CircuitOpenError struct {
+		Host string
+		// when trial requests will be allowed
+		RetryAt time.Time
+	}
+
+	circuit struct {
+		state       BreakerState
+		consecutive uint
+		requests    uint
+		failures    uint
+		windowStart time.Time
+		openedAt    time.Time
+		trials      uint
+	}
+)
+
+const (
+	StateClosed   BreakerState = "closed"
+	StateOpen     BreakerState = "open"
+	StateHalfOpen BreakerState = "half-open"
+)
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("rest/client: circuit open for %s until %s", e.Host, e.RetryAt.Format(time.RFC3339))
+}
+
+// NewBreaker - creates breaker, attach it with Client.SetBreaker.
+// Breaker can be shared by clients calling the same hosts.
+func NewBreaker(options BreakerOptions) *Breaker {
+	if options.ConsecutiveFailures == 0 {
+		options.ConsecutiveFailures = 5
+	}
+	if options.MinRequests == 0 {
+		options.MinRequests = 10
+	}
+	if options.Window <= 0 {
+		options.Window = time.Minute
+	}
+	if options.Cooldown <= 0 {
+		options.Cooldown = 30 * time.Second
+	}
+	if options.HalfOpenRequests == 0 {
+		options.HalfOpenRequests = 1
+	}
+	return &Breaker{
+		options:   options,
+		circuits:  make(map[string]*circuit),
+		callbacks: make([]func(string, BreakerState), 0),
+	}
+}
+
+// State - current state of host circuit
+func (b *Breaker) State(host string) BreakerState {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.circuit(host).state
+}
+
+// Watch - callback is called on every state change of any host circuit.
+// It is called synchronously, so it should not block.
+func (b *Breaker) Watch(callback func(host string, state BreakerState)) {
+	b.m.Lock()
+	b.callbacks = append(b.callbacks, callback)
+	b.m.Unlock()
+}
+
+// Critical - marks host as critical upstream, service is reported
+// as not ready under readinessKey while host circuit is open
+func (b *Breaker) Critical(host string, readinessKey string) {
+	readiness.Set(readinessKey, b.State(host) != StateOpen)
+	b.Watch(func(h string, state BreakerState) {
+		if h == host {
+			readiness.Set(readinessKey, state != StateOpen)
+		}
+	})
+}
+
+// Checks if request to host can be sent
+func (b *Breaker) allow(host string) error {
+	b.m.Lock()
+	c := b.circuit(host)
+	changes := make([]BreakerState, 0)
+	switch c.state {
+	case StateOpen:
+		retryAt := c.openedAt.Add(b.options.Cooldown)
+		if time.Now().Before(retryAt) {
+			b.m.Unlock()
+			return &CircuitOpenError{Host: host, RetryAt: retryAt}
+		}
+		c.trials = 0
+		changes = b.setState(c, StateHalfOpen, changes)
+		fallthrough
+	case StateHalfOpen:
+		if c.trials >= b.options.HalfOpenRequests {
+			b.unlock(host, changes)
+			return &CircuitOpenError{Host: host, RetryAt: time.Now().Add(b.options.Cooldown)}
+		}
+		c.trials++
+	}
+	b.unlock(host, changes)
+	return nil
+}
+
+// Records result of request sent to host
+func (b *Breaker) report(host string, success bool) {
+	b.m.Lock()
+	c := b.circuit(host)
+	changes := make([]BreakerState, 0)
+	now := time.Now()
+	if now.Sub(c.windowStart) > b.options.Window {
+		c.windowStart = now
+		c.requests = 0
+		c.failures = 0
+	}
+	c.requests++
+
+	if success {
+		c.consecutive = 0
+		if c.state == StateHalfOpen {
+			c.requests = 0
+			c.failures = 0
+			changes = b.setState(c, StateClosed, changes)
+		}
+	} else {
+		c.consecutive++
+		c.failures++
+		if c.state == StateHalfOpen || b.tripped(c) {
+			c.openedAt = now
+			changes = b.setState(c, StateOpen, changes)
+			// half-open without waiting for request, readiness can recover without traffic
+			time.AfterFunc(b.options.Cooldown, func() { b.halfOpen(host, now) })
+		}
+	}
+	b.unlock(host, changes)
+}
+
+// Moves circuit opened at openedAt to half-open after cooldown
+func (b *Breaker) halfOpen(host string, openedAt time.Time) {
+	b.m.Lock()
+	c := b.circuit(host)
+	changes := make([]BreakerState, 0)
+	if c.state == StateOpen && c.openedAt.Equal(openedAt) {
+		c.trials = 0
+		changes = b.setState(c, StateHalfOpen, changes)
+	}
+	b.unlock(host, changes)
+}
+
+// Frees trial slot taken by request that was cancelled before result was known
+func (b *Breaker) release(host string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	c := b.circuit(host)
+	if c.state == StateHalfOpen && c.trials > 0 {
+		c.trials--
+	}
+}
+
+// server errors and throttling mean upstream is unhealthy, other codes count as success
+func breakerFailure(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
+
+// has to be called with lock held
+func (b *Breaker) tripped(c *circuit) bool {
+	if c.state != StateClosed {
+		return false
+	}
+	if c.consecutive >= b.options.ConsecutiveFailures {
+		return true
+	}
+	return b.options.FailureRatio > 0 &&
+		c.requests >= b.options.MinRequests &&
+		float64(c.failures)/float64(c.requests) >= b.options.FailureRatio
+}
+
+// has to be called with lock held
+func (b *Breaker) circuit(host string) *circuit {
+	c, ok := b.circuits[host]
+	if !ok {
+		c = &circuit{state: StateClosed, windowStart: time.Now()}
+		b.circuits[host] = c
+	}
+	return c
+}
+
+// has to be called with lock held, returns changes extended with new state
+func (b *Breaker) setState(c *circuit, state BreakerState, changes []BreakerState) []BreakerState {
+	if c.state == state {
+		return changes
+	}
+	c.state = state
+	c.consecutive = 0
+	return append(changes, state)
+}
+
+// Releases lock and informs watchers about state changes
+func (b *Breaker) unlock(host string, changes []BreakerState) {
+	callbacks := append([]func(string, BreakerState){}, b.callbacks...)
+	b.m.Unlock()
+	for _, state := range changes {
+		for _, callback := range callbacks {
+			callback(host, state)
+		}
+	}
+}
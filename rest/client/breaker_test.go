@@ -0,0 +1,102 @@
+package client
+
+import (
+	"github.com/hop-city/common/readiness"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBreaker_ConsecutiveFailures(t *testing.T) {
+	b := NewBreaker(BreakerOptions{ConsecutiveFailures: 2, Cooldown: 20 * time.Millisecond})
+	var m sync.Mutex
+	changes := make([]BreakerState, 0)
+	b.Watch(func(host string, state BreakerState) {
+		m.Lock()
+		changes = append(changes, state)
+		m.Unlock()
+	})
+
+	b.report("a", false)
+	b.report("a", true)
+	b.report("a", false)
+	assert.Equal(t, StateClosed, b.State("a"), "Success should reset consecutive failures")
+	b.report("a", false)
+	assert.Equal(t, StateOpen, b.State("a"), "Circuit should open after consecutive failures")
+	assert.Equal(t, StateClosed, b.State("b"), "Circuits should be kept per host")
+
+	err := b.allow("a")
+	_, ok := err.(*CircuitOpenError)
+	assert.True(t, ok, "Open circuit should return typed error")
+
+	<-time.After(25 * time.Millisecond)
+	assert.Nil(t, b.allow("a"), "Trial request should be allowed after cooldown")
+	assert.Equal(t, StateHalfOpen, b.State("a"), "Circuit should be half-open")
+	assert.NotNil(t, b.allow("a"), "Only one trial request should be allowed")
+	b.report("a", false)
+	assert.Equal(t, StateOpen, b.State("a"), "Failed trial should open circuit again")
+
+	<-time.After(25 * time.Millisecond)
+	_ = b.allow("a")
+	b.report("a", true)
+	assert.Equal(t, StateClosed, b.State("a"), "Successful trial should close circuit")
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, []BreakerState{StateOpen, StateHalfOpen, StateOpen, StateHalfOpen, StateClosed}, changes,
+		"All state changes should be observed")
+}
+
+func TestBreaker_Critical(t *testing.T) {
+	b := NewBreaker(BreakerOptions{ConsecutiveFailures: 1, Cooldown: 20 * time.Millisecond})
+	b.Critical("critical", "breaker-critical")
+	defer readiness.Set("breaker-critical", true)
+
+	b.report("critical", false)
+	assert.False(t, readiness.IsReady(), "Open circuit of critical host should make service not ready")
+
+	// no traffic while not ready
+	<-time.After(30 * time.Millisecond)
+	assert.Equal(t, StateHalfOpen, b.State("critical"), "Circuit should be half-open after cooldown without requests")
+	assert.True(t, readiness.IsReady(), "Readiness should recover after cooldown")
+}
+
+func TestBreaker_FailureRatio(t *testing.T) {
+	b := NewBreaker(BreakerOptions{ConsecutiveFailures: 100, FailureRatio: 0.5, MinRequests: 4})
+	b.report("a", false)
+	b.report("a", true)
+	b.report("a", false)
+	assert.Equal(t, StateClosed, b.State("a"), "Ratio should not be checked below min requests")
+	b.report("a", true)
+	b.report("a", false)
+	assert.Equal(t, StateOpen, b.State("a"), "Circuit should open when ratio is reached")
+}
+
+func TestClient_Fetch_Breaker(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	b := NewBreaker(BreakerOptions{ConsecutiveFailures: 3})
+	client := New(ctx, nil).SetMaxRetries(10).SetBreaker(b)
+	_, err := client.Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+	_, ok := errors.Cause(err).(*CircuitOpenError)
+	assert.True(t, ok, "Retries should stop when circuit opens - %s", err)
+	assert.Equal(t, 3, count, "Only requests before opening should be sent")
+	assert.Equal(t, StateOpen, b.State(u.Host), "Circuit should be keyed by host")
+
+	_, err = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+	_, ok = errors.Cause(err).(*CircuitOpenError)
+	assert.True(t, ok, "Open circuit should fail fast")
+	assert.Equal(t, 3, count, "No request should be sent while circuit is open")
+}
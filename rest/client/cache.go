@@ -0,0 +1,294 @@
+package client
+
+import (
+	"bytes"
+	"container/list"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// CacheStore - storage for cached responses, has to be safe for concurrent use
+	CacheStore interface {
+		Get(key string) (*CachedResponse, bool)
+		Set(key string, r *CachedResponse)
+		Delete(key string)
+	}
+
+	// CachedResponse - stored successful response with its validators
+	CachedResponse struct {
+		StatusCode int
+		Header     http.Header
+		Body       []byte
+		// fresh until, zero - has to be revalidated before use
+		Expires time.Time
+		// request header values the response varies on
+		Vary map[string]string
+	}
+
+	// Cache - private HTTP cache for GET requests, attach with Client.SetCache.
+	// Fresh responses are served without request, stale ones are revalidated
+	// with If-None-Match and If-Modified-Since. Responses to requests with
+	// Authorization header are cached only if marked public or with s-maxage.
+	Cache struct {
+		store CacheStore
+	}
+
+	// LRUStore - in memory store keeping up to max entries
+	LRUStore struct {
+		m       sync.Mutex
+		max     int
+		entries map[string]*list.Element
+		order   *list.List
+	}
+
+	lruEntry struct {
+		key      string
+		response *CachedResponse
+	}
+
+	cacheControl map[string]string
+)
+
+// NewCache - creates cache, LRU store for 1000 responses is used if store is nil
+func NewCache(store CacheStore) *Cache {
+	if store == nil {
+		store = NewLRUStore(1000)
+	}
+	return &Cache{store: store}
+}
+
+// NewLRUStore - creates store evicting least recently used responses above max entries
+func NewLRUStore(max int) *LRUStore {
+	return &LRUStore{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (s *LRUStore) Get(key string) (*CachedResponse, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(el)
+	return el.Value.(*lruEntry).response, true
+}
+
+func (s *LRUStore) Set(key string, r *CachedResponse) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if el, ok := s.entries[key]; ok {
+		el.Value.(*lruEntry).response = r
+		s.order.MoveToFront(el)
+		return
+	}
+	s.entries[key] = s.order.PushFront(&lruEntry{key: key, response: r})
+	for s.order.Len() > s.max {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (s *LRUStore) Delete(key string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.order.Remove(el)
+		delete(s.entries, key)
+	}
+}
+
+// Len - number of stored responses
+func (s *LRUStore) Len() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.order.Len()
+}
+
+// Finds stored response matching request, nil if request bypasses cache
+func (c *Cache) lookup(req *http.Request) *CachedResponse {
+	if !cacheable(req) {
+		return nil
+	}
+	cached, ok := c.store.Get(cacheKey(req))
+	if !ok {
+		return nil
+	}
+	for name, value := range cached.Vary {
+		if req.Header.Get(name) != value {
+			return nil
+		}
+	}
+	return cached
+}
+
+// Fresh response can be served without contacting upstream
+func (c *Cache) fresh(req *http.Request, cached *CachedResponse) bool {
+	if _, ok := parseCacheControl(req.Header)["no-cache"]; ok {
+		return false
+	}
+	return time.Now().Before(cached.Expires)
+}
+
+// Adds validators of stored response to request, unless caller set own conditions
+func (c *Cache) conditional(req *http.Request, cached *CachedResponse) {
+	if req.Header.Get("if-none-match") != "" || req.Header.Get("if-modified-since") != "" {
+		return
+	}
+	if etag := cached.Header.Get("etag"); etag != "" {
+		req.Header.Set("if-none-match", etag)
+	}
+	if modified := cached.Header.Get("last-modified"); modified != "" {
+		req.Header.Set("if-modified-since", modified)
+	}
+}
+
+// Updates stored response with headers of 304 response and returns it
+func (c *Cache) revalidated(req *http.Request, cached *CachedResponse, resp *http.Response) (*http.Response, []byte) {
+	header := cloneHeader(cached.Header)
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	updated := &CachedResponse{
+		StatusCode: cached.StatusCode,
+		Header:     header,
+		Body:       cached.Body,
+		Expires:    expires(header),
+		Vary:       cached.Vary,
+	}
+	c.store.Set(cacheKey(req), updated)
+	return updated.response(req), updated.Body
+}
+
+// Stores successful response if caching is allowed
+func (c *Cache) save(req *http.Request, resp *http.Response, data []byte) {
+	if !cacheable(req) || resp.StatusCode != http.StatusOK {
+		return
+	}
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return
+	}
+	if !shared(req, cc) {
+		return
+	}
+	vary := make(map[string]string)
+	for _, field := range resp.Header["Vary"] {
+		for _, name := range strings.Split(field, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary[name] = req.Header.Get(name)
+			}
+		}
+	}
+	cached := &CachedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     cloneHeader(resp.Header),
+		Body:       data,
+		Expires:    expires(resp.Header),
+		Vary:       vary,
+	}
+	validators := cached.Header.Get("etag") != "" || cached.Header.Get("last-modified") != ""
+	if !validators && !time.Now().Before(cached.Expires) {
+		return
+	}
+	c.store.Set(cacheKey(req), cached)
+}
+
+func (r *CachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(r.StatusCode) + " " + http.StatusText(r.StatusCode),
+		StatusCode:    r.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(r.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}
+}
+
+// only GET requests not opting out with no-store
+func cacheable(req *http.Request) bool {
+	if req.Method != "" && req.Method != "GET" {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// Responses to authorised requests are stored only if marked public or with s-maxage,
+// otherwise one user's response could be served to another one
+func shared(req *http.Request, cc cacheControl) bool {
+	if req.Header.Get("authorization") == "" {
+		return true
+	}
+	_, public := cc["public"]
+	_, sMaxAge := cc["s-maxage"]
+	return public || sMaxAge
+}
+
+func cacheKey(req *http.Request) string {
+	return req.URL.String()
+}
+
+// Freshness deadline from max-age or Expires, zero if response has to be revalidated
+func expires(header http.Header) time.Time {
+	cc := parseCacheControl(header)
+	if _, ok := cc["no-cache"]; ok {
+		return time.Time{}
+	}
+	if maxAge, ok := cc["max-age"]; ok {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil || seconds <= 0 {
+			return time.Time{}
+		}
+		age, _ := strconv.Atoi(header.Get("age"))
+		return time.Now().Add(time.Duration(seconds-age) * time.Second)
+	}
+	if value := header.Get("expires"); value != "" {
+		// invalid date means already expired
+		t, _ := http.ParseTime(value)
+		return t
+	}
+	return time.Time{}
+}
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, field := range header["Cache-Control"] {
+		for _, directive := range strings.Split(field, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			cc[strings.ToLower(name)] = value
+		}
+	}
+	return cc
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_Fetch_CacheFresh(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("cache-control", "max-age=60")
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"koala"}`))
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetCache(NewCache(nil))
+
+	for i := 0; i < 3; i++ {
+		var expect map[string]string
+		resp, err := client.Fetch(FetchOptions{Method: "GET", Url: ts.URL, Expect: &expect})
+		assert.Nil(t, err, "No error expected")
+		assert.Equal(t, 200, resp.StatusCode, "Cached status expected")
+		assert.Equal(t, "koala", expect["name"], "Cached body should be decoded")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "Fresh response should be served from cache")
+
+	_, _ = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL, Headers: map[string]string{"cache-control": "no-cache"}})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "Request no-cache should skip fresh response")
+
+	_, _ = client.Fetch(FetchOptions{Method: "POST", Url: ts.URL})
+	_, _ = client.Fetch(FetchOptions{Method: "POST", Url: ts.URL})
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls), "POST should not be cached")
+}
+
+func TestClient_Fetch_CacheRevalidate(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	var calls, notModified int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("etag", `"v1"`)
+		w.Header().Set("cache-control", "no-cache")
+		if r.Header.Get("if-none-match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("koala"))
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetCache(NewCache(nil))
+
+	for i := 0; i < 2; i++ {
+		var expect string
+		resp, err := client.Fetch(FetchOptions{Method: "GET", Url: ts.URL, Expect: &expect})
+		assert.Nil(t, err, "No error expected")
+		assert.Equal(t, 200, resp.StatusCode, "304 should be served as cached 200")
+		assert.Equal(t, "koala", expect, "Cached body expected")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "Stale response should be revalidated")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified), "Conditional request expected")
+}
+
+func TestClient_Fetch_CacheLastModified(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	modified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	var conditional string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = r.Header.Get("if-modified-since")
+		w.Header().Set("last-modified", modified)
+		w.Header().Set("expires", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+		_, _ = w.Write([]byte("koala"))
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetCache(NewCache(nil))
+
+	_, _ = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+	assert.Equal(t, "", conditional, "First request should not be conditional")
+	_, _ = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+	assert.Equal(t, modified, conditional, "Expired response should be revalidated with Last-Modified")
+}
+
+func TestClient_Fetch_CacheNoStore(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	store := NewLRUStore(10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/no-store":
+			w.Header().Set("cache-control", "no-store, max-age=60")
+		case "/vary":
+			w.Header().Set("cache-control", "max-age=60")
+			w.Header().Set("vary", "*")
+		case "/error":
+			w.Header().Set("cache-control", "max-age=60")
+			w.WriteHeader(http.StatusNotFound)
+		case "/plain":
+		default:
+			w.Header().Set("cache-control", "max-age=60")
+		}
+		_, _ = w.Write([]byte("koala"))
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetCache(NewCache(store))
+
+	for _, path := range []string{"/no-store", "/vary", "/error", "/plain"} {
+		_, _ = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL + path})
+	}
+	assert.Equal(t, 0, store.Len(), "Responses should not be stored")
+	_, _ = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL + "/ok", Stream: true})
+	assert.Equal(t, 0, store.Len(), "Streamed response should not be stored")
+	_, _ = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL + "/ok"})
+	assert.Equal(t, 1, store.Len(), "Response should be stored")
+}
+
+func TestClient_Fetch_CacheVary(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("cache-control", "max-age=60")
+		w.Header().Set("vary", "Accept-Language")
+		_, _ = w.Write([]byte(r.Header.Get("accept-language")))
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetCache(NewCache(nil))
+
+	fetch := func(lang string) string {
+		var expect string
+		_, _ = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL, Expect: &expect, Headers: map[string]string{"accept-language": lang}})
+		return expect
+	}
+	assert.Equal(t, "en", fetch("en"))
+	assert.Equal(t, "en", fetch("en"))
+	assert.Equal(t, "pl", fetch("pl"), "Different vary header should not be served from cache")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestLRUStore(t *testing.T) {
+	store := NewLRUStore(2)
+	store.Set("a", &CachedResponse{})
+	store.Set("b", &CachedResponse{})
+	_, _ = store.Get("a")
+	store.Set("c", &CachedResponse{})
+	_, ok := store.Get("b")
+	assert.False(t, ok, "Least recently used entry should be evicted")
+	_, ok = store.Get("a")
+	assert.True(t, ok, "Recently used entry should stay")
+	store.Delete("a")
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestClient_Fetch_CacheAuthorization(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/public" {
+			w.Header().Set("cache-control", "public, max-age=60")
+		} else {
+			w.Header().Set("cache-control", "max-age=60")
+		}
+		_, _ = w.Write([]byte(r.Header.Get("authorization")))
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetCache(NewCache(nil))
+
+	fetch := func(path, token string) string {
+		var expect string
+		_, _ = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL + path, Expect: &expect, Headers: map[string]string{"authorization": "Bearer " + token}})
+		return expect
+	}
+	assert.Equal(t, "Bearer user-a", fetch("/private", "user-a"))
+	assert.Equal(t, "Bearer user-b", fetch("/private", "user-b"), "Authorised response should not be served to other user")
+	assert.Equal(t, "Bearer user-a", fetch("/private", "user-a"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "Authorised private responses should not be cached")
+
+	assert.Equal(t, "Bearer user-a", fetch("/public", "user-a"))
+	assert.Equal(t, "Bearer user-a", fetch("/public", "user-b"), "Public response should be shared")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
@@ -3,15 +3,15 @@ package client
 import (
 	"bytes"
 	"context"
-	"encoding/json"
-	"github.com/hop-city/common/backoff"
+	"github.com/hop-city/common/rest/codec"
+	"github.com/hop-city/common/rest/forward"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,48 +22,64 @@ type (
 		httpClient           *http.Client
 		auth                 Auth
 		maxRetries           uint
-		backoff              *backoff.Backoff
+		retryPolicy          RetryPolicy
+		breaker              *Breaker
+		limiter              *Limiter
+		cache                *Cache
 		closeConnection      bool
 		favourContentHeaders bool
-		retryStatusCodes     []int
 	}
 
 	Auth interface {
-		GetToken() <-chan string
+		Token(ctx context.Context) (string, error)
 		Refresh()
-		AppendHeader(*http.Header)
+		AppendHeader(ctx context.Context, h *http.Header) error
+	}
+
+	// ContextRefresher - Auth with tokens per request ctx (e.g. auth.TokenExchange).
+	// On 401 RefreshContext is called with request ctx instead of Refresh.
+	ContextRefresher interface {
+		RefreshContext(ctx context.Context)
 	}
 
 	FetchOptions struct {
-		Ctx     context.Context
-		Method  string
-		Url     string
-		Send    interface{}
+		// request scope - cancels request and retries, client ctx is used if nil
+		Ctx    context.Context
+		Method string
+		Url    string
+		// io.Reader is streamed, but request is not retried unless GetBody is set.
+		// *Multipart is sent as multipart/form-data.
+		Send interface{}
+		// returns fresh body for every attempt, overrides Send
+		GetBody func() (io.Reader, error)
 		Expect  interface{}
 		Headers map[string]string
-		no      int
+		// response body is not read, Expect is ignored and caller has to close resp.Body.
+		// Client timeout covers reading the body - consider SetTimeout(0) for long streams.
+		Stream bool
+		no     int
+	}
+
+	// response body handed to caller in stream mode
+	streamBody struct {
+		io.ReadCloser
+		release func()
 	}
 )
 
-var requestCount = 0
+var requestCount int64
+
+const mediaTypeStream = "application/octet-stream"
 
 // for now let's try
 // go-resty/resty
 // github.com/go-resty/resty/v2 v2.0.0
 
-// TODO(mb) add headers forwarding from context
-
-// TODO(mb) retrying adds each new retry to stack because of direct return
-//  Shall we make it flat?
-
-// TODO(mb) getting header is potentially forever blocking
-//  How to best approach this?
 func New(ctx context.Context, auth Auth) *Client {
 	hc := &http.Client{
 		Timeout: 30 * time.Second,
 	}
 
-	backoff := backoff.New().SetJitter(0.3).SetBaseDuration(1)
 	c := &Client{
 		ctx: ctx,
 		log: zerolog.Ctx(ctx),
@@ -71,11 +87,9 @@ func New(ctx context.Context, auth Auth) *Client {
 		httpClient:           hc,
 		auth:                 auth,
 		maxRetries:           0,
-		backoff:              backoff,
+		retryPolicy:          NewRetryPolicy(),
 		closeConnection:      false,
 		favourContentHeaders: false,
-		// https://httpstatuses.com
-		retryStatusCodes: []int{408, 500, 503, 504},
 	}
 
 	return c
@@ -84,6 +98,31 @@ func (c *Client) SetMaxRetries(retries uint) *Client {
 	c.maxRetries = retries
 	return c
 }
+
+// SetRetryPolicy - replaces DefaultRetryPolicy, max retries limit still applies
+func (c *Client) SetRetryPolicy(policy RetryPolicy) *Client {
+	c.retryPolicy = policy
+	return c
+}
+
+// SetBreaker - requests to hosts with open circuit fail fast with CircuitOpenError
+func (c *Client) SetBreaker(breaker *Breaker) *Client {
+	c.breaker = breaker
+	return c
+}
+
+// SetLimiter - requests over the limits wait within request ctx
+func (c *Client) SetLimiter(limiter *Limiter) *Client {
+	c.limiter = limiter
+	return c
+}
+
+// SetCache - GET responses are cached and revalidated according to response headers,
+// streamed requests bypass cache
+func (c *Client) SetCache(cache *Cache) *Client {
+	c.cache = cache
+	return c
+}
 func (c *Client) SetTimeout(seconds time.Duration) *Client {
 	c.httpClient.Timeout = seconds * time.Second
 	return c
@@ -98,140 +137,288 @@ func (c *Client) FavourContentHeaders(do bool) *Client {
 }
 
 func (c *Client) Fetch(opt FetchOptions) (*http.Response, error) {
-	requestCount++
-	opt.no = requestCount
-	return c.fetch(opt, nil, nil, 0)
+	opt.no = int(atomic.AddInt64(&requestCount, 1))
+	return c.fetch(opt)
 }
 
-func (c *Client) fetch(opt FetchOptions, lastResponse *http.Response, lastError error, retry uint) (*http.Response, error) {
+func (c *Client) fetch(opt FetchOptions) (*http.Response, error) {
 	var log *zerolog.Logger
-	if opt.Ctx != nil {
-		log = zerolog.Ctx(opt.Ctx)
+	ctx := opt.Ctx
+	if ctx != nil {
+		log = zerolog.Ctx(ctx)
 	} else {
+		ctx = c.ctx
 		log = c.log
 	}
 
-	if retry > c.maxRetries {
-		// no more retries
-		if lastResponse != nil {
-			log.Debug().Msgf(
-				"[%d/%d] rest/client.Fetch: %d No more retries. skipping %s",
-				opt.no,
-				retry-1,
-				lastResponse.StatusCode,
-				opt.Url,
-			)
+	for attempt := uint(0); ; attempt++ {
+		if ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "[%d] rest/client.Fetch: request cancelled", attempt)
+		}
+		body, contentType, err := payload(opt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "[%d] rest/client.Fetch: error creating body:", attempt)
+		}
+		req, err := http.NewRequest(opt.Method, opt.Url, body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "[%d] rest/client.Fetch: error creating request:", attempt)
+		}
+		req = req.WithContext(ctx)
+		if c.closeConnection {
+			req.Close = true
+		}
+		err = c.setHeaders(req, opt, contentType)
+		if err != nil {
+			return nil, errors.Wrapf(&AuthError{Err: err}, "[%d] rest/client.Fetch: error authorising request", attempt)
+		}
+		var cached *CachedResponse
+		if c.cache != nil && !opt.Stream {
+			cached = c.cache.lookup(req)
+		}
+		if cached != nil && c.cache.fresh(req, cached) {
+			log.Debug().Msgf("[%d/%d] rest/client.Fetch: served from cache %s", opt.no, attempt, opt.Url)
+			resp, err := c.readBody(&opt, cached.response(req), cached.Body)
+			if err != nil {
+				return resp, &DecodeError{Err: err}
+			}
+			return resp, nil
+		}
+		if cached != nil {
+			c.cache.conditional(req, cached)
+		}
+
+		resp, data, err := c.send(req, opt.Stream)
+		if err != nil && ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "[%d] rest/client.Fetch: request cancelled", attempt)
+		}
+		if _, open := err.(*CircuitOpenError); open {
+			return nil, errors.Wrapf(err, "[%d] rest/client.Fetch", attempt)
+		}
+		if err != nil {
+			err = errors.Wrapf(&NetworkError{Err: err}, "[%d] rest/client.Fetch: error sending request", attempt)
 		} else {
+			if cached != nil && resp.StatusCode == http.StatusNotModified {
+				resp, data = c.cache.revalidated(req, cached, resp)
+			} else if c.cache != nil && !opt.Stream {
+				c.cache.save(req, resp, data)
+			}
+			d := string(data)
+			if len(d) > 100 {
+				d = d[0:100] + "..."
+			}
 			log.Debug().Msgf(
-				"[%d/%d] rest/client.Fetch: No more retries. No response. skipping %s",
+				"[%d/%d] rest/client.Fetch: %d %s %s %s",
 				opt.no,
-				retry-1,
+				attempt,
+				resp.StatusCode,
+				resp.Header.Get("content-type"),
 				opt.Url,
+				d,
 			)
+			if resp.StatusCode < 400 && opt.Stream {
+				return resp, nil
+			}
+			if resp.StatusCode < 400 {
+				// resolve body type based on content-type and opt.Expected
+				resp, err = c.readBody(&opt, resp, data)
+				if err != nil {
+					return resp, &DecodeError{Err: err}
+				}
+				return resp, nil
+			}
+			err = newHTTPError(req, resp, data, attempt)
 		}
-		return lastResponse, lastError
-	} else if retry > 0 && lastResponse != nil {
-		// still got retries, shall continue?
-		if !c.shouldRetry(lastResponse) {
+
+		retry, wait := c.shouldRetry(attempt, req, resp, err)
+		if retry && !replayable(opt) {
 			log.Debug().Msgf(
-				"[%d/%d] rest/client.Fetch: Code %d will not be retried, skipping %s",
+				"[%d/%d] rest/client.Fetch: Streamed body can not be sent again, skipping %s",
 				opt.no,
-				retry-1,
-				lastResponse.StatusCode,
+				attempt,
 				opt.Url,
 			)
-			return lastResponse, lastError
+			return resp, err
+		}
+		if !retry {
+			if resp != nil {
+				log.Debug().Msgf(
+					"[%d/%d] rest/client.Fetch: %d will not be retried, skipping %s",
+					opt.no,
+					attempt,
+					resp.StatusCode,
+					opt.Url,
+				)
+			} else {
+				log.Debug().Msgf(
+					"[%d/%d] rest/client.Fetch: No response, will not be retried, skipping %s",
+					opt.no,
+					attempt,
+					opt.Url,
+				)
+			}
+			return resp, err
 		}
 		log.Debug().Msgf(
-			"[%d/%d] rest/client.Fetch: %d Retrying: %s",
+			"[%d/%d] rest/client.Fetch: Retrying in %s: %s",
 			opt.no,
-			retry-1,
-			lastResponse.StatusCode,
+			attempt,
+			wait,
 			opt.Url,
 		)
-	}
-	<-c.backoff.Wait(c.ctx, retry)
 
-	bodyReader := readPayload(opt.Send)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, errors.Wrapf(ctx.Err(), "[%d] rest/client.Fetch: request cancelled while waiting for retry", attempt)
+		case <-c.ctx.Done():
+			timer.Stop()
+			return resp, errors.Wrapf(c.ctx.Err(), "[%d] rest/client.Fetch: client closed while waiting for retry", attempt)
+		case <-timer.C:
+		}
+	}
+}
 
-	req, err := http.NewRequest(opt.Method, opt.Url, bodyReader)
-	if err != nil {
-		return nil, errors.Wrapf(err, "[%d] rest/client.Fetch: error creating request:", retry)
+// Sends single attempt through limiter and breaker. Response body is read into memory,
+// unless successful response is streamed - then limiter slot is released on body close.
+func (c *Client) send(req *http.Request, stream bool) (*http.Response, []byte, error) {
+	ctx := req.Context()
+	host := req.URL.Host
+	var release func()
+	if c.limiter != nil {
+		var err error
+		release, err = c.limiter.acquire(ctx, host)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			if release != nil {
+				release()
+			}
+		}()
 	}
-	if c.closeConnection {
-		req.Close = true
+	if c.breaker != nil {
+		err := c.breaker.allow(host)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
-	c.setHeaders(req, opt)
 
 	resp, err := c.httpClient.Do(req)
+	if err != nil && ctx.Err() != nil {
+		if c.breaker != nil {
+			c.breaker.release(host)
+		}
+		// url.Error hides ctx error from errors.Cause
+		return nil, nil, ctx.Err()
+	}
+	if c.breaker != nil {
+		c.breaker.report(host, err == nil && !breakerFailure(resp.StatusCode))
+	}
 	if err != nil {
-		err = errors.Wrapf(err, "[%d] rest/client.Fetch: error sending request:", retry)
-		return c.fetch(opt, nil, err, retry+1)
+		return nil, nil, err
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
+	if stream && resp.StatusCode < 400 {
+		resp.Body = &streamBody{ReadCloser: resp.Body, release: release}
+		release = nil
+		return resp, nil, nil
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
 	_ = resp.Body.Close()
 	resp.Body = ioutil.NopCloser(bytes.NewBuffer(data))
+	return resp, data, nil
+}
 
-	d := string(data)
-	if len(d) > 100 {
-		d = d[0:100] + "..."
-	}
-	log.Debug().Msgf(
-		"[%d/%d] rest/client.Fetch: %d %s %s %s",
-		opt.no,
-		retry,
-		resp.StatusCode,
-		resp.Header.Get("content-type"),
-		opt.Url,
-		d,
-	)
-	if resp.StatusCode == 401 {
-		if c.auth != nil {
+// Decides if failed attempt should be repeated and how long to wait.
+// 401 is retried right after token refresh if auth is set.
+func (c *Client) shouldRetry(attempt uint, req *http.Request, resp *http.Response, err error) (bool, time.Duration) {
+	if resp != nil && resp.StatusCode == 401 {
+		if c.auth == nil {
+			return false, 0
+		}
+		if r, ok := c.auth.(ContextRefresher); ok {
+			r.RefreshContext(req.Context())
+		} else {
 			c.auth.Refresh()
-			return c.fetch(opt, resp, err, retry+1)
 		}
-		return resp, errors.Errorf("[%d] rest/client.Fetch: unauthorised - code %d - %s", retry, resp.StatusCode, data)
+		return attempt < c.maxRetries, 0
 	}
-	if resp.StatusCode >= 400 {
-		err = errors.Errorf("[%d] rest/client.Fetch: Error %d %s %s", retry, resp.StatusCode, opt.Url, data)
-		return c.fetch(opt, resp, err, retry+1)
+	if attempt >= c.maxRetries {
+		return false, 0
 	}
-
-	// resolve body type based on content-type and opt.Expected
-	return c.readBody(&opt, resp, data)
+	return c.retryPolicy.Retry(attempt+1, req, resp, err)
 }
 
-func readPayload(payload interface{}) io.Reader {
-	var bodyReader io.Reader
-	switch payload.(type) {
+// Request body for single attempt and its default content type.
+// Structured data is encoded with codec for content-type set in headers,
+// or guessed from data type.
+func payload(opt FetchOptions) (io.Reader, string, error) {
+	if opt.GetBody != nil {
+		body, err := opt.GetBody()
+		return body, mediaTypeStream, err
+	}
+	switch send := opt.Send.(type) {
 	case nil:
-		bodyReader = nil
-	case map[string]string:
-		data, _ := payload.(map[string]string)
-		query := url.Values{}
-		for k, v := range data {
-			query.Set(k, v)
+		return nil, codec.MediaTypeJSON, nil
+	case *Multipart:
+		if err := send.validate(); err != nil {
+			return nil, "", err
 		}
-		bodyReader = bytes.NewReader([]byte(query.Encode()))
+		return send.body(), send.ContentType(), nil
 	case []byte:
-		b, _ := payload.([]byte)
-		bodyReader = bytes.NewReader(b)
+		return bytes.NewReader(send), codec.MediaTypeJSON, nil
 	case string:
-		str, _ := payload.(string)
-		bodyReader = bytes.NewReader([]byte(str))
-	default:
-		data, _ := json.Marshal(payload)
-		bodyReader = bytes.NewReader(data)
+		return strings.NewReader(send), codec.MediaTypeText, nil
+	case io.Reader:
+		return send, mediaTypeStream, nil
+	}
+
+	contentType := ""
+	for k, v := range opt.Headers {
+		if strings.EqualFold(k, "content-type") {
+			contentType = v
+		}
+	}
+	c, ok := codec.Get(contentType)
+	if !ok {
+		contentType = codec.MediaTypeFor(opt.Send)
+		c, _ = codec.Get(contentType)
+	}
+	data, err := c.Marshal(opt.Send)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "error encoding %T as %s", opt.Send, codec.MediaType(contentType))
+	}
+	return bytes.NewReader(data), contentType, nil
+}
+
+// Streamed payload can be sent only once
+func replayable(opt FetchOptions) bool {
+	if opt.GetBody != nil {
+		return true
 	}
-	return bodyReader
+	switch send := opt.Send.(type) {
+	case *Multipart:
+		return send.replayable()
+	case io.Reader:
+		return false
+	}
+	return true
 }
 
-func (c *Client) setHeaders(req *http.Request, opt FetchOptions) {
+func (c *Client) setHeaders(req *http.Request, opt FetchOptions, contentType string) error {
+	// Forwarded from incoming request - see middleware.ForwardHeaders
+	for k, v := range forward.Headers(opt.Ctx) {
+		req.Header[k] = v
+	}
+
 	// Auth
 	if c.auth != nil {
-		// blocking
-		c.auth.AppendHeader(&req.Header)
+		// blocks until token is available or request ctx is closed
+		err := c.auth.AppendHeader(req.Context(), &req.Header)
+		if err != nil {
+			return err
+		}
 	}
 
 	// User headers
@@ -242,95 +429,34 @@ func (c *Client) setHeaders(req *http.Request, opt FetchOptions) {
 	}
 
 	// Data type
-	if req.Header.Get("content-type") != "" {
-		return
-	}
-	switch opt.Send.(type) {
-	case map[string]string:
-		req.Header.Set("content-type", "application/x-www-form-urlencoded")
-	case string:
-		req.Header.Set("content-type", "text/plain")
-	default: // []byte too
-		req.Header.Set("content-type", "application/json")
+	if req.Header.Get("content-type") == "" {
+		req.Header.Set("content-type", contentType)
 	}
+	return nil
+}
 
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.release != nil {
+		b.release()
+	}
+	return err
 }
 
 func (c *Client) readBody(opt *FetchOptions, resp *http.Response, data []byte) (*http.Response, error) {
-	if c.favourContentHeaders {
-		switch resp.Header.Get("content-type") {
-		case "text/plain":
-			if out, ok := opt.Expect.(*string); ok {
-				*out = string(data)
-			}
-			return resp, nil
-
-		case "application/x-www-form-urlencoded":
-			if out, ok := opt.Expect.(map[string]string); ok {
-				params, err := url.ParseQuery(string(data))
-				if err != nil {
-					return resp, errors.Errorf("rest/client.Fetch: error parsing urlencoded data - '%s'", data)
-				}
-				for k, v := range params {
-					out[k] = strings.Join(v, ",")
-				}
-			} else {
-				if opt.Expect != nil {
-					return resp, errors.Errorf(
-						"rest/client.Fetch: received urlencoded data but expected data is of type %T", opt.Expect)
-				}
-			}
-			return resp, nil
-
-		case "application/json":
-			if opt.Expect != nil {
-				var err error
-				if out, ok := opt.Expect.(*[]byte); ok {
-					*out = data
-				} else {
-					err = json.Unmarshal(data, opt.Expect)
-				}
-				if err != nil {
-					return resp, errors.Errorf("rest/client.Fetch: error unmarshalling JSON data - '%s'", data)
-				}
-			}
-			return resp, nil
-		}
-	}
-	// no content type header provided, guessing based on user input
 	if opt.Expect == nil {
 		return resp, nil
 	}
-
-	if out, ok := opt.Expect.(*[]byte); ok {
-		*out = data
-	} else if out, ok := opt.Expect.(*string); ok {
-		*out = string(data)
-	} else if out, ok := opt.Expect.(map[string]string); ok {
-		params, err := url.ParseQuery(string(data))
-		if err != nil {
-			return resp, errors.Errorf("rest/client.Fetch: error parsing urlencoded data - '%s'", data)
-		}
-		for k, v := range params {
-			out[k] = strings.Join(v, ",")
-		}
-	} else {
-		err := json.Unmarshal(data, opt.Expect)
-		if err != nil {
-			return resp, errors.Errorf("rest/client.Fetch: error unmarshalling JSON data - '%s'", data)
-		}
+	contentType := resp.Header.Get("content-type")
+	decoder, ok := codec.Get(contentType)
+	if !c.favourContentHeaders || !ok {
+		// no content type header provided, guessing based on user input
+		contentType = codec.MediaTypeFor(opt.Expect)
+		decoder, _ = codec.Get(contentType)
 	}
-	return resp, nil
-}
-
-func (c *Client) shouldRetry(resp *http.Response) bool {
-	hit := false
-	current := resp.StatusCode
-	for _, v := range c.retryStatusCodes {
-		if v == current {
-			hit = true
-			break
-		}
+	err := codec.Decode(decoder, data, opt.Expect)
+	if err != nil {
+		return resp, errors.Wrapf(err, "rest/client.Fetch: error decoding %s data - '%s'", codec.MediaType(contentType), data)
 	}
-	return hit
+	return resp, nil
 }
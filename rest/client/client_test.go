@@ -3,11 +3,14 @@ package client
 import (
 	"context"
 	"github.com/hop-city/common/logger"
+	"github.com/hop-city/common/rest/forward"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -25,15 +28,18 @@ type Server struct {
 
 type AuthMock struct {
 	token string
+	err   error
 }
 
-func (a *AuthMock) GetToken() <-chan string {
-	ch := make(chan string, 1)
-	ch <- a.token
-	return ch
+func (a *AuthMock) Token(ctx context.Context) (string, error) {
+	return a.token, a.err
 }
-func (a *AuthMock) AppendHeader(h *http.Header) {
+func (a *AuthMock) AppendHeader(ctx context.Context, h *http.Header) error {
+	if a.err != nil {
+		return a.err
+	}
 	h.Set("authorization", a.token)
+	return nil
 }
 func (a *AuthMock) Refresh() {
 	a.token = a.token + "+"
@@ -261,6 +267,22 @@ func TestClient_Fetch_Auth(t *testing.T) {
 		"There should be 2 requests, 401 and 200")
 }
 
+func TestClient_Fetch_AuthError(t *testing.T) {
+	ctx, cancel, s := setup()
+	defer cancel()
+	authErr := errors.New("invalid credentials")
+	au := &AuthMock{token: "token", err: authErr}
+	client := New(ctx, au)
+
+	resp, err := client.Fetch(FetchOptions{
+		Method: "GET",
+		Url:    s.Ts.URL,
+	})
+	assert.Nil(t, resp, "No response should be returned")
+	assert.Equal(t, authErr, errors.Cause(err), "Auth error should be returned")
+	assert.Equal(t, 0, s.ReqCount, "Request should not be sent without authorisation")
+}
+
 func TestClient_Fetch_Sending(t *testing.T) {
 	ctx, cancel, s := setup()
 	defer cancel()
@@ -312,3 +334,95 @@ func TestClient_Fetch_Sending(t *testing.T) {
 	assert.Equal(t, "koala", s.LastCType,
 		"Header should be overridden")
 }
+
+func TestClient_Fetch_ForwardHeaders(t *testing.T) {
+	ctx, cancel, s := setup()
+	defer cancel()
+	client := New(ctx, &AuthMock{token: "token"})
+
+	incoming := http.Header{}
+	incoming.Set("x-request-id", "koala-1")
+	incoming.Set("authorization", "incoming")
+	reqCtx := forward.WithHeaders(ctx, incoming)
+	_, _ = client.Fetch(FetchOptions{
+		Ctx:     reqCtx,
+		Method:  "GET",
+		Url:     s.Ts.URL,
+		Headers: map[string]string{"accept-language": "pl"},
+	})
+	assert.Equal(t, "koala-1", s.LastReq.Header.Get("x-request-id"), "Request ID should be forwarded")
+	assert.Equal(t, "token", s.LastReq.Header.Get("authorization"), "Auth should override forwarded header")
+	assert.Equal(t, "pl", s.LastReq.Header.Get("accept-language"), "User headers should be sent")
+
+	_, _ = client.Fetch(FetchOptions{
+		Method: "GET",
+		Url:    s.Ts.URL,
+	})
+	assert.Empty(t, s.LastReq.Header.Get("x-request-id"), "Nothing is forwarded without request ctx")
+}
+
+func TestClient_Fetch_Context(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		if r.URL.Path == "/slow" {
+			<-time.After(200 * time.Millisecond)
+		}
+		w.Header().Set("retry-after", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetMaxRetries(5)
+
+	reqCtx, reqCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer reqCancel()
+	start := time.Now()
+	_, err := client.Fetch(FetchOptions{Ctx: reqCtx, Method: "GET", Url: ts.URL + "/slow"})
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err), "Deadline should stop request")
+	assert.True(t, time.Since(start) < 150*time.Millisecond, "Request should not wait for response")
+
+	atomic.StoreInt32(&count, 0)
+	reqCtx, reqCancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer reqCancel()
+	_, err = client.Fetch(FetchOptions{Ctx: reqCtx, Method: "GET", Url: ts.URL})
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err), "Deadline should stop waiting for retry")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count), "Request should not be retried after deadline")
+
+	reqCtx, reqCancel = context.WithCancel(ctx)
+	reqCancel()
+	_, err = client.Fetch(FetchOptions{Ctx: reqCtx, Method: "GET", Url: ts.URL})
+	assert.Equal(t, context.Canceled, errors.Cause(err), "Cancelled request should not be sent")
+}
+
+func TestClient_Fetch_Codecs(t *testing.T) {
+	ctx, cancel, s := setup()
+	defer cancel()
+	client := New(ctx, nil).FavourContentHeaders(true)
+
+	s.NextContentType = "application/json; charset=utf-8"
+	s.NextBody = []byte(`{"Name":"koala"}`)
+	out := map[string]string{}
+	_, err := client.Fetch(FetchOptions{Method: "GET", Url: s.Ts.URL, Expect: out})
+	assert.Nil(t, err, "Content type parameters should be ignored")
+	assert.Equal(t, "koala", out["Name"], "JSON should be decoded by content type")
+
+	s.NextContentType = "application/xml"
+	s.NextBody = []byte(`<koala><Name>Bob</Name></koala>`)
+	user := struct{ Name string }{}
+	_, err = client.Fetch(FetchOptions{Method: "GET", Url: s.Ts.URL, Expect: &user})
+	assert.Nil(t, err, "XML should be decoded")
+	assert.Equal(t, "Bob", user.Name, "XML should be decoded")
+
+	type koala struct {
+		Name string `xml:"name"`
+	}
+	_, _ = client.Fetch(FetchOptions{
+		Method:  "POST",
+		Url:     s.Ts.URL,
+		Send:    koala{Name: "Bob"},
+		Headers: map[string]string{"content-type": "application/xml"},
+	})
+	assert.Equal(t, "<koala><name>Bob</name></koala>", s.LastBody, "Payload should be encoded with codec for content type")
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type (
+	// HTTPError - upstream responded with status code >= 400
+	HTTPError struct {
+		StatusCode int
+		Method     string
+		URL        string
+		// number of sent requests, including retries
+		Attempts uint
+		Header   http.Header
+		// truncated to maxErrorBody bytes
+		Body string
+	}
+
+	// NetworkError - request could not be sent or response was not received
+	NetworkError struct {
+		Err error
+	}
+
+	// DecodeError - response body could not be read into FetchOptions.Expect
+	DecodeError struct {
+		Err error
+	}
+
+	// AuthError - Auth failed to provide authorisation header
+	AuthError struct {
+		Err error
+	}
+)
+
+const maxErrorBody = 1024
+
+func newHTTPError(req *http.Request, resp *http.Response, data []byte, attempt uint) *HTTPError {
+	body := string(data)
+	if len(body) > maxErrorBody {
+		body = body[0:maxErrorBody] + "..."
+	}
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Attempts:   attempt + 1,
+		Header:     resp.Header,
+		Body:       body,
+	}
+}
+
+func (e *HTTPError) Error() string {
+	if e.StatusCode == http.StatusUnauthorized {
+		return fmt.Sprintf("[%d] rest/client.Fetch: unauthorised - code %d - %s", e.Attempts-1, e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("[%d] rest/client.Fetch: Error %d %s %s %s", e.Attempts-1, e.StatusCode, e.Method, e.URL, e.Body)
+}
+
+// errors.Cause returns underlying error, errors.As can be used to match the type
+
+func (e *NetworkError) Error() string { return "network error: " + e.Err.Error() }
+func (e *NetworkError) Cause() error  { return e.Err }
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+func (e *DecodeError) Error() string { return "decode error: " + e.Err.Error() }
+func (e *DecodeError) Cause() error  { return e.Err }
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+func (e *AuthError) Error() string { return "auth error: " + e.Err.Error() }
+func (e *AuthError) Cause() error  { return e.Err }
+func (e *AuthError) Unwrap() error { return e.Err }
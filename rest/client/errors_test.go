@@ -0,0 +1,59 @@
+package client
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClient_Fetch_HTTPError(t *testing.T) {
+	ctx, cancel, s := setup()
+	defer cancel()
+	client := New(ctx, nil).SetMaxRetries(1)
+
+	s.NextStatus = http.StatusNotFound
+	_, err := client.Fetch(FetchOptions{Method: "GET", Url: s.Ts.URL + "/koala"})
+	var httpErr *HTTPError
+	assert.True(t, errors.As(err, &httpErr), "HTTPError should be returned - %s", err)
+	assert.Equal(t, http.StatusNotFound, httpErr.StatusCode, "Status code should be set")
+	assert.Equal(t, "GET", httpErr.Method, "Method should be set")
+	assert.Equal(t, s.Ts.URL+"/koala", httpErr.URL, "URL should be set")
+	assert.Equal(t, uint(1), httpErr.Attempts, "404 should not be retried")
+	assert.Equal(t, "text/plain", httpErr.Header.Get("content-type"), "Headers should be set")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(strings.Repeat("a", 2*maxErrorBody)))
+	}))
+	defer ts.Close()
+	_, err = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+	assert.True(t, errors.As(err, &httpErr), "HTTPError should be returned - %s", err)
+	assert.Equal(t, uint(2), httpErr.Attempts, "Retries should be counted")
+	assert.Equal(t, maxErrorBody+3, len(httpErr.Body), "Body should be truncated")
+}
+
+func TestClient_Fetch_TypedErrors(t *testing.T) {
+	ctx, cancel, s := setup()
+	defer cancel()
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	_, err := New(ctx, nil).Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+	var netErr *NetworkError
+	assert.True(t, errors.As(err, &netErr), "NetworkError should be returned - %s", err)
+
+	var user struct{ Name string }
+	s.NextBody = []byte("not json")
+	_, err = New(ctx, nil).Fetch(FetchOptions{Method: "GET", Url: s.Ts.URL, Expect: &user})
+	var decodeErr *DecodeError
+	assert.True(t, errors.As(err, &decodeErr), "DecodeError should be returned - %s", err)
+
+	authErr := errors.New("invalid credentials")
+	_, err = New(ctx, &AuthMock{err: authErr}).Fetch(FetchOptions{Method: "GET", Url: s.Ts.URL})
+	var aErr *AuthError
+	assert.True(t, errors.As(err, &aErr), "AuthError should be returned - %s", err)
+	assert.Equal(t, authErr, errors.Cause(err), "Original error should be kept")
+}
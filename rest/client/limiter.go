@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	LimitOptions struct {
+		// requests per second, 0 - unlimited
+		Rate float64
+		// requests that can be sent at once after idle period - 1 by default
+		Burst uint
+		// maximum number of requests in flight, 0 - unlimited
+		MaxInFlight uint
+	}
+
+	// Limiter - token bucket rate limiter with in-flight requests cap.
+	// Requests over the limit wait until they are allowed or request ctx is closed.
+	Limiter struct {
+		m     sync.Mutex
+		all   *limit
+		hosts map[string]*limit
+	}
+
+	limit struct {
+		m        sync.Mutex
+		options  LimitOptions
+		tokens   float64
+		last     time.Time
+		inFlight chan struct{}
+	}
+)
+
+// NewLimiter - creates limiter shared by all hosts called by client,
+// attach it with Client.SetLimiter
+func NewLimiter(options LimitOptions) *Limiter {
+	return &Limiter{
+		all:   newLimit(options),
+		hosts: make(map[string]*limit),
+	}
+}
+
+// SetHost - sets separate limits for host (host:port as in url),
+// requests to that host are not counted into client wide limits
+func (l *Limiter) SetHost(host string, options LimitOptions) *Limiter {
+	l.m.Lock()
+	l.hosts[host] = newLimit(options)
+	l.m.Unlock()
+	return l
+}
+
+func newLimit(options LimitOptions) *limit {
+	if options.Burst == 0 {
+		options.Burst = 1
+	}
+	lim := &limit{
+		options: options,
+		tokens:  float64(options.Burst),
+		last:    time.Now(),
+	}
+	if options.MaxInFlight > 0 {
+		lim.inFlight = make(chan struct{}, options.MaxInFlight)
+	}
+	return lim
+}
+
+// Waits for rate limit and free in-flight slot.
+// Returned function has to be called when request is done.
+func (l *Limiter) acquire(ctx context.Context, host string) (func(), error) {
+	l.m.Lock()
+	lim, ok := l.hosts[host]
+	if !ok {
+		lim = l.all
+	}
+	l.m.Unlock()
+
+	if err := lim.wait(ctx); err != nil {
+		return nil, err
+	}
+	if lim.inFlight == nil {
+		return func() {}, nil
+	}
+	select {
+	case lim.inFlight <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-lim.inFlight })
+	}, nil
+}
+
+// Reserves token from bucket and waits until it is available
+func (lim *limit) wait(ctx context.Context) error {
+	if lim.options.Rate <= 0 {
+		return nil
+	}
+	lim.m.Lock()
+	now := time.Now()
+	lim.tokens += now.Sub(lim.last).Seconds() * lim.options.Rate
+	if burst := float64(lim.options.Burst); lim.tokens > burst {
+		lim.tokens = burst
+	}
+	lim.last = now
+	lim.tokens--
+	var delay time.Duration
+	if lim.tokens < 0 {
+		delay = time.Duration(-lim.tokens / lim.options.Rate * float64(time.Second))
+	}
+	lim.m.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// give reserved token back
+		lim.m.Lock()
+		lim.tokens++
+		lim.m.Unlock()
+		return ctx.Err()
+	}
+}
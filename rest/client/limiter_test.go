@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Rate(t *testing.T) {
+	ctx := context.Background()
+	l := NewLimiter(LimitOptions{Rate: 50, Burst: 2})
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		release, err := l.acquire(ctx, "a")
+		assert.Nil(t, err, "Request should be allowed")
+		release()
+	}
+	// burst of 2, then 2 more at 20ms intervals
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 35*time.Millisecond, "Requests over burst should wait - %s", elapsed)
+
+	short, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	_, err := l.acquire(short, "a")
+	assert.Equal(t, context.DeadlineExceeded, err, "Waiting should stop with ctx")
+}
+
+func TestLimiter_InFlight(t *testing.T) {
+	ctx := context.Background()
+	l := NewLimiter(LimitOptions{MaxInFlight: 1}).SetHost("b", LimitOptions{})
+	release, _ := l.acquire(ctx, "a")
+
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := l.acquire(short, "a")
+	assert.Equal(t, context.DeadlineExceeded, err, "Second request should wait for free slot")
+	_, err = l.acquire(short, "b")
+	assert.Nil(t, err, "Host with own limits should not be affected")
+
+	release()
+	release()
+	_, err = l.acquire(ctx, "a")
+	assert.Nil(t, err, "Slot should be freed once")
+}
+
+func TestClient_Fetch_Limiter(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	var m sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		m.Unlock()
+		<-time.After(10 * time.Millisecond)
+		m.Lock()
+		inFlight--
+		m.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	client := New(ctx, nil).SetLimiter(NewLimiter(LimitOptions{}).SetHost(u.Host, LimitOptions{MaxInFlight: 2}))
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+			assert.Nil(t, err, "Requests over the limit should wait")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2, maxInFlight, "In flight requests should be capped")
+
+	client = New(ctx, nil).SetLimiter(NewLimiter(LimitOptions{Rate: 1}))
+	_, _ = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+	reqCtx, reqCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer reqCancel()
+	_, err := client.Fetch(FetchOptions{Ctx: reqCtx, Method: "GET", Url: ts.URL})
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err), "Request ctx should limit waiting")
+}
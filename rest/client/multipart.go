@@ -0,0 +1,166 @@
+package client
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// Multipart - multipart/form-data payload for FetchOptions.Send.
+	// Body is streamed and built again for every retry.
+	Multipart struct {
+		Fields map[string]string
+		Files  []MultipartFile
+
+		once     sync.Once
+		boundary string
+	}
+
+	// MultipartFile - file part. Open is used for every attempt if set,
+	// otherwise Reader is rewound if it implements io.Seeker.
+	// Plain Reader can be sent only once, so request is not retried.
+	MultipartFile struct {
+		Field       string
+		FileName    string
+		ContentType string
+		Reader      io.Reader
+		Open        func() (io.Reader, error)
+	}
+
+	// builds multipart body when it's read for the first time,
+	// so nothing is left running if request is never sent
+	multipartBody struct {
+		m      *Multipart
+		once   sync.Once
+		reader *io.PipeReader
+	}
+)
+
+// ContentType - content type header with boundary
+func (m *Multipart) ContentType() string {
+	m.once.Do(func() {
+		m.boundary = multipart.NewWriter(nil).Boundary()
+	})
+	return "multipart/form-data; boundary=" + m.boundary
+}
+
+// Every file needs Reader or Open
+func (m *Multipart) validate() error {
+	for i, f := range m.Files {
+		if f.Reader == nil && f.Open == nil {
+			return errors.Errorf("multipart file %d (%s) has neither Reader nor Open", i, f.Field)
+		}
+	}
+	return nil
+}
+
+func (m *Multipart) replayable() bool {
+	for _, f := range m.Files {
+		if f.Open != nil {
+			continue
+		}
+		if _, ok := f.Reader.(io.Seeker); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Multipart) body() io.ReadCloser {
+	m.ContentType()
+	return &multipartBody{m: m}
+}
+
+func (b *multipartBody) Read(p []byte) (int, error) {
+	b.once.Do(b.start)
+	if b.reader == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return b.reader.Read(p)
+}
+
+func (b *multipartBody) Close() error {
+	b.once.Do(func() {})
+	if b.reader != nil {
+		return b.reader.Close()
+	}
+	return nil
+}
+
+func (b *multipartBody) start() {
+	pr, pw := io.Pipe()
+	b.reader = pr
+	go func() {
+		_ = pw.CloseWithError(b.m.write(pw))
+	}()
+}
+
+func (m *Multipart) write(w io.Writer) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(m.boundary); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(m.Fields))
+	for k := range m.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := mw.WriteField(k, m.Fields[k]); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range m.Files {
+		r, err := f.open()
+		if err != nil {
+			return err
+		}
+		part, err := mw.CreatePart(f.header())
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if c, ok := r.(io.Closer); ok && f.Open != nil {
+			_ = c.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func (f *MultipartFile) open() (io.Reader, error) {
+	if f.Open != nil {
+		r, err := f.Open()
+		if err == nil && r == nil {
+			err = errors.Errorf("multipart file %s: Open returned nil reader", f.Field)
+		}
+		return r, err
+	}
+	if s, ok := f.Reader.(io.Seeker); ok {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return f.Reader, nil
+}
+
+func (f *MultipartFile) header() textproto.MIMEHeader {
+	escape := strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition",
+		`form-data; name="`+escape(f.Field)+`"; filename="`+escape(f.FileName)+`"`)
+	contentType := f.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+	return h
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type upload struct {
+	name     string
+	fileName string
+	cType    string
+	content  string
+}
+
+func TestClient_Fetch_Multipart(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	fields := make([]string, 0)
+	files := make([]upload, 0)
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		assert.Nil(t, r.ParseMultipartForm(1<<20), "Multipart body should be parsed")
+		fields = append(fields, r.FormValue("title"))
+		for name, headers := range r.MultipartForm.File {
+			for _, h := range headers {
+				f, _ := h.Open()
+				b, _ := ioutil.ReadAll(f)
+				files = append(files, upload{name, h.Filename, h.Header.Get("content-type"), string(b)})
+			}
+		}
+		if count == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetMaxRetries(1)
+
+	_, err := client.Fetch(FetchOptions{
+		Method: "POST",
+		Url:    ts.URL,
+		Send: &Multipart{
+			Fields: map[string]string{"title": "koala"},
+			Files: []MultipartFile{
+				{Field: "doc", FileName: "koala.txt", ContentType: "text/plain", Reader: bytes.NewReader([]byte("eucalyptus"))},
+				{Field: "img", FileName: "koala.png", Open: func() (io.Reader, error) {
+					return strings.NewReader("png"), nil
+				}},
+			},
+		},
+	})
+	assert.Nil(t, err, "Request should succeed after retry")
+	assert.Equal(t, 2, count, "Request should be retried")
+	assert.Equal(t, []string{"koala", "koala"}, fields, "Fields should be sent on every attempt")
+	sent := []upload{
+		{"doc", "koala.txt", "text/plain", "eucalyptus"},
+		{"img", "koala.png", "application/octet-stream", "png"},
+	}
+	assert.ElementsMatch(t, append(sent, sent...), files, "Files should be rebuilt for retry")
+
+	count = 0
+	_, _ = client.Fetch(FetchOptions{
+		Method: "POST",
+		Url:    ts.URL,
+		Send: &Multipart{Files: []MultipartFile{
+			{Field: "doc", FileName: "koala.txt", Reader: ioutil.NopCloser(strings.NewReader("once"))},
+		}},
+	})
+	assert.Equal(t, 1, count, "Plain reader can not be replayed")
+}
+
+func TestClient_Fetch_MultipartInvalid(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+	client := New(ctx, nil)
+
+	_, err := client.Fetch(FetchOptions{Method: "POST", Url: ts.URL, Send: &Multipart{
+		Files: []MultipartFile{{Field: "file", FileName: "koala.txt"}},
+	}})
+	assert.Error(t, err, "File without Reader or Open should be rejected")
+	assert.Equal(t, 0, calls, "Request should not be sent")
+
+	_, err = client.Fetch(FetchOptions{Method: "POST", Url: ts.URL, Send: &Multipart{
+		Files: []MultipartFile{{Field: "file", FileName: "koala.txt", Open: func() (io.Reader, error) {
+			return nil, nil
+		}}},
+	}})
+	assert.Error(t, err, "Nil reader from Open should fail the request")
+}
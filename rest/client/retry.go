@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"github.com/hop-city/common/backoff"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type (
+	// RetryPolicy - decides if failed attempt should be repeated.
+	// It is called with attempt number (starting with 1 for first retry),
+	// sent request and either received response or transport error.
+	// Number of retries is always limited by Client.SetMaxRetries.
+	RetryPolicy interface {
+		Retry(attempt uint, req *http.Request, resp *http.Response, err error) (bool, time.Duration)
+	}
+
+	// DefaultRetryPolicy - retries listed status codes and connection errors
+	// with exponential backoff, honouring Retry-After header.
+	// Requests with non idempotent methods are retried only if server
+	// didn't process them (408, 429, 503 or connection not established).
+	DefaultRetryPolicy struct {
+		StatusCodes []int
+		// retry POST and PATCH on all listed codes and on any transport error
+		RetryNonIdempotent bool
+		// stop retrying if server asks to wait longer, 0 - no limit
+		MaxRetryAfter time.Duration
+		Backoff       *backoff.Backoff
+	}
+)
+
+// https://httpstatuses.com
+var defaultRetryStatusCodes = []int{408, 429, 500, 503, 504}
+
+// NewRetryPolicy - default policy used by client
+func NewRetryPolicy() *DefaultRetryPolicy {
+	return &DefaultRetryPolicy{
+		StatusCodes:   append([]int{}, defaultRetryStatusCodes...),
+		MaxRetryAfter: time.Minute,
+		Backoff:       backoff.New().SetJitter(0.3).SetBaseDuration(1),
+	}
+}
+
+func (p *DefaultRetryPolicy) Retry(attempt uint, req *http.Request, resp *http.Response, err error) (bool, time.Duration) {
+	if resp == nil {
+		if err == nil || !p.retryError(req, err) {
+			return false, 0
+		}
+		return true, p.backoff(attempt)
+	}
+
+	if !containsCode(p.StatusCodes, resp.StatusCode) {
+		return false, 0
+	}
+	if !idempotent(req.Method) && !p.RetryNonIdempotent && !notProcessed(resp.StatusCode) {
+		return false, 0
+	}
+	if wait, ok := RetryAfter(resp); ok {
+		if p.MaxRetryAfter > 0 && wait > p.MaxRetryAfter {
+			return false, 0
+		}
+		return true, wait
+	}
+	return true, p.backoff(attempt)
+}
+
+func (p *DefaultRetryPolicy) backoff(attempt uint) time.Duration {
+	if p.Backoff == nil {
+		return 0
+	}
+	return p.Backoff.Duration(attempt)
+}
+
+func (p *DefaultRetryPolicy) retryError(req *http.Request, err error) bool {
+	cause := errors.Cause(err)
+	if urlErr, ok := cause.(*url.Error); ok {
+		cause = urlErr.Err
+	}
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return false
+	}
+	if idempotent(req.Method) || p.RetryNonIdempotent {
+		return true
+	}
+	// request never reached the server
+	opErr, ok := cause.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// RetryAfter - reads Retry-After header given in seconds or as HTTP date
+func RetryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("retry-after")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// codes meaning request was not handled, safe to repeat for any method
+func notProcessed(code int) bool {
+	return code == http.StatusRequestTimeout ||
+		code == http.StatusTooManyRequests ||
+		code == http.StatusServiceUnavailable
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func containsCode(codes []int, code int) bool {
+	for _, v := range codes {
+		if v == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func response(code int, retryAfter string) *http.Response {
+	resp := &http.Response{StatusCode: code, Header: http.Header{}}
+	if retryAfter != "" {
+		resp.Header.Set("retry-after", retryAfter)
+	}
+	return resp
+}
+
+func TestRetryAfter(t *testing.T) {
+	wait, ok := RetryAfter(response(429, "3"))
+	assert.True(t, ok, "Seconds should be parsed")
+	assert.Equal(t, 3*time.Second, wait, "Seconds should be parsed")
+
+	date := time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	wait, ok = RetryAfter(response(503, date))
+	assert.True(t, ok, "HTTP date should be parsed")
+	assert.True(t, wait > 8*time.Second && wait <= 10*time.Second, "Wait should match date - %s", wait)
+
+	wait, _ = RetryAfter(response(503, time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+	assert.Equal(t, time.Duration(0), wait, "Past date means no wait")
+	_, ok = RetryAfter(response(503, "soon"))
+	assert.False(t, ok, "Invalid value should be ignored")
+	_, ok = RetryAfter(response(503, ""))
+	assert.False(t, ok, "Missing header should be ignored")
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	p := NewRetryPolicy()
+	get := httptest.NewRequest("GET", "/", nil)
+	post := httptest.NewRequest("POST", "/", nil)
+
+	retry, _ := p.Retry(1, get, response(500, ""), nil)
+	assert.True(t, retry, "GET should be retried on 500")
+	retry, _ = p.Retry(1, post, response(500, ""), nil)
+	assert.False(t, retry, "POST could be processed, should not be retried on 500")
+	retry, _ = p.Retry(1, post, response(429, ""), nil)
+	assert.True(t, retry, "POST should be retried on 429")
+	retry, _ = p.Retry(1, get, response(404, ""), nil)
+	assert.False(t, retry, "404 should not be retried")
+
+	retry, wait := p.Retry(1, get, response(503, "2"), nil)
+	assert.True(t, retry, "503 should be retried")
+	assert.Equal(t, 2*time.Second, wait, "Retry-After should be honoured")
+	retry, _ = p.Retry(1, get, response(503, "3600"), nil)
+	assert.False(t, retry, "Retry-After over limit should stop retrying")
+
+	dialErr := &url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: errors.New("refused")}}
+	readErr := &url.Error{Op: "Post", Err: &net.OpError{Op: "read", Err: errors.New("reset")}}
+	retry, _ = p.Retry(1, post, nil, dialErr)
+	assert.True(t, retry, "Request not sent should be retried")
+	retry, _ = p.Retry(1, post, nil, readErr)
+	assert.False(t, retry, "POST could be processed, should not be retried")
+	retry, _ = p.Retry(1, get, nil, readErr)
+	assert.True(t, retry, "GET should be retried on network error")
+	retry, _ = p.Retry(1, get, nil, &url.Error{Op: "Get", Err: context.Canceled})
+	assert.False(t, retry, "Canceled request should not be retried")
+
+	p.RetryNonIdempotent = true
+	retry, _ = p.Retry(1, post, response(500, ""), nil)
+	assert.True(t, retry, "POST should be retried when allowed")
+}
+
+func TestClient_Fetch_Retry(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	count := 0
+	statuses := []int{429, 503, 200}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("retry-after", "0")
+		w.WriteHeader(statuses[count%len(statuses)])
+		count++
+		_, _ = w.Write([]byte(strconv.Itoa(count)))
+	}))
+	defer ts.Close()
+
+	var body string
+	_, err := New(ctx, nil).SetMaxRetries(5).Fetch(FetchOptions{Method: "POST", Url: ts.URL, Expect: &body})
+	assert.Nil(t, err, "Request should succeed after retries")
+	assert.Equal(t, "3", body, "Third attempt should succeed")
+
+	count = 0
+	resp, err := New(ctx, nil).SetMaxRetries(1).Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+	assert.NotNil(t, err, "Error should be returned when retries are exhausted")
+	assert.Equal(t, 503, resp.StatusCode, "Last response should be returned")
+	assert.Equal(t, 2, count, "Retries should be limited")
+
+	count = 0
+	_, _ = New(ctx, nil).SetMaxRetries(5).
+		SetRetryPolicy(&DefaultRetryPolicy{StatusCodes: []int{500}}).
+		Fetch(FetchOptions{Method: "GET", Url: ts.URL})
+	assert.Equal(t, 1, count, "Custom policy should be used")
+}
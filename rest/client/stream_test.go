@@ -0,0 +1,78 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient_Fetch_StreamUpload(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	bodies := make([]string, 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		assert.Equal(t, "application/octet-stream", r.Header.Get("content-type"), "Stream content type expected")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetMaxRetries(2)
+
+	_, err := client.Fetch(FetchOptions{Method: "PUT", Url: ts.URL, Send: strings.NewReader("koala")})
+	assert.NotNil(t, err, "Error should be returned")
+	assert.Equal(t, []string{"koala"}, bodies, "Reader can not be replayed, request should not be retried")
+
+	bodies = make([]string, 0)
+	_, _ = client.Fetch(FetchOptions{
+		Method: "PUT",
+		Url:    ts.URL,
+		GetBody: func() (io.Reader, error) {
+			return strings.NewReader("koala"), nil
+		},
+	})
+	assert.Equal(t, []string{"koala", "koala", "koala"}, bodies, "Body from GetBody should be retried")
+}
+
+func TestClient_Fetch_StreamResponse(t *testing.T) {
+	ctx, cancel, _ := setup()
+	defer cancel()
+	next := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 2; i++ {
+			_, _ = w.Write([]byte(`{"n":1}` + "\n"))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer ts.Close()
+	client := New(ctx, nil).SetLimiter(NewLimiter(LimitOptions{MaxInFlight: 1}))
+
+	var expect string
+	resp, err := client.Fetch(FetchOptions{Method: "GET", Url: ts.URL, Stream: true, Expect: &expect})
+	assert.Nil(t, err, "Stream should be opened")
+	// first line is available before response is finished
+	line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.Equal(t, `{"n":1}`+"\n", line, "First line should be streamed")
+	assert.Empty(t, expect, "Expect should be ignored in stream mode")
+
+	short, shortCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer shortCancel()
+	_, err = client.Fetch(FetchOptions{Ctx: short, Method: "GET", Url: ts.URL, Stream: true})
+	assert.NotNil(t, err, "Open stream should hold in-flight slot")
+
+	close(next)
+	_ = resp.Body.Close()
+	resp, err = client.Fetch(FetchOptions{Method: "GET", Url: ts.URL, Stream: true})
+	assert.Nil(t, err, "Slot should be released when body is closed")
+	_ = resp.Body.Close()
+}
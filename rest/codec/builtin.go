@@ -0,0 +1,125 @@
+package codec
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"net/url"
+	"strings"
+)
+
+type (
+	JSON struct{}
+
+	// Form - urlencoded values, decoded into map[string]string
+	// (multiple values joined with comma) or url.Values
+	Form struct{}
+
+	// Text - string, []byte, error and fmt.Stringer values
+	Text struct{}
+
+	XML struct{}
+
+	// ProtoJSON - proto.Message values in protobuf JSON mapping, including
+	// well known types. Unknown fields are ignored when decoding.
+	ProtoJSON struct{}
+)
+
+func (JSON) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (Form) Marshal(v interface{}) ([]byte, error) {
+	switch in := v.(type) {
+	case map[string]string:
+		query := url.Values{}
+		for k, v := range in {
+			query.Set(k, v)
+		}
+		return []byte(query.Encode()), nil
+	case url.Values:
+		return []byte(in.Encode()), nil
+	case map[string][]string:
+		return []byte(url.Values(in).Encode()), nil
+	}
+	return nil, errors.Errorf("codec.Form: can not encode %T", v)
+}
+
+func (Form) Unmarshal(data []byte, v interface{}) error {
+	params, err := url.ParseQuery(string(data))
+	if err != nil {
+		return errors.Wrap(err, "codec.Form")
+	}
+	switch out := v.(type) {
+	case map[string]string:
+		for k, v := range params {
+			out[k] = strings.Join(v, ",")
+		}
+	case url.Values:
+		for k, v := range params {
+			out[k] = v
+		}
+	case *url.Values:
+		*out = params
+	default:
+		return errors.Errorf("codec.Form: can not decode into %T", v)
+	}
+	return nil
+}
+
+func (Text) Marshal(v interface{}) ([]byte, error) {
+	switch in := v.(type) {
+	case string:
+		return []byte(in), nil
+	case []byte:
+		return in, nil
+	case error:
+		return []byte(in.Error()), nil
+	case fmt.Stringer:
+		return []byte(in.String()), nil
+	}
+	return nil, errors.Errorf("codec.Text: can not encode %T", v)
+}
+
+func (Text) Unmarshal(data []byte, v interface{}) error {
+	switch out := v.(type) {
+	case *string:
+		*out = string(data)
+	case *[]byte:
+		*out = data
+	default:
+		return errors.Errorf("codec.Text: can not decode into %T", v)
+	}
+	return nil
+}
+
+func (XML) Marshal(v interface{}) ([]byte, error) {
+	return xml.Marshal(v)
+}
+
+func (XML) Unmarshal(data []byte, v interface{}) error {
+	return xml.Unmarshal(data, v)
+}
+
+func (ProtoJSON) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.Errorf("codec.ProtoJSON: can not encode %T", v)
+	}
+	return protojson.Marshal(m)
+}
+
+func (ProtoJSON) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errors.Errorf("codec.ProtoJSON: can not decode into %T", v)
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, m)
+}
@@ -0,0 +1,242 @@
+package codec
+
+import (
+	"mime"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Codec - encodes and decodes bodies of single media type
+	Codec interface {
+		Marshal(v interface{}) ([]byte, error)
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	// Registry - codecs keyed by media type
+	Registry struct {
+		m      sync.RWMutex
+		codecs map[string]Codec
+		// registration order, used when Accept allows many types
+		order []string
+	}
+
+	acceptRange struct {
+		mediaType string
+		q         float64
+	}
+)
+
+const (
+	MediaTypeJSON      = "application/json"
+	MediaTypeForm      = "application/x-www-form-urlencoded"
+	MediaTypeText      = "text/plain"
+	MediaTypeXML       = "application/xml"
+	MediaTypeTextXML   = "text/xml"
+	MediaTypeProtoJSON = "application/protobuf+json"
+)
+
+// Default - registry used by rest/client and rest/server
+var Default = NewRegistry()
+
+// NewRegistry - creates registry with built in codecs
+func NewRegistry() *Registry {
+	r := &Registry{
+		codecs: make(map[string]Codec),
+		order:  make([]string, 0),
+	}
+	r.Register(MediaTypeJSON, JSON{})
+	r.Register(MediaTypeForm, Form{})
+	r.Register(MediaTypeText, Text{})
+	r.Register(MediaTypeXML, XML{})
+	r.Register(MediaTypeTextXML, XML{})
+	r.Register(MediaTypeProtoJSON, ProtoJSON{})
+	return r
+}
+
+// Register - adds or replaces codec for media type in Default registry
+func Register(mediaType string, c Codec) {
+	Default.Register(mediaType, c)
+}
+
+// Get - finds codec in Default registry, see Registry.Get
+func Get(contentType string) (Codec, bool) {
+	return Default.Get(contentType)
+}
+
+// Negotiate - picks codec from Default registry, see Registry.Negotiate
+func Negotiate(accept string) (string, Codec, bool) {
+	return Default.Negotiate(accept)
+}
+
+// NegotiateFor - picks codec from Default registry, see Registry.NegotiateFor
+func NegotiateFor(accept, contentType string) (string, Codec, bool) {
+	return Default.NegotiateFor(accept, contentType)
+}
+
+// Register - adds or replaces codec for media type
+func (r *Registry) Register(mediaType string, c Codec) {
+	mediaType = MediaType(mediaType)
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, ok := r.codecs[mediaType]; !ok {
+		r.order = append(r.order, mediaType)
+	}
+	r.codecs[mediaType] = c
+}
+
+// Get - finds codec for Content-Type header value. Parameters like charset
+// are ignored and structured syntax suffixes (+json, +xml) fall back
+// to JSON and XML codecs, e.g. for application/problem+json.
+func (r *Registry) Get(contentType string) (Codec, bool) {
+	mediaType := MediaType(contentType)
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if c, ok := r.codecs[mediaType]; ok {
+		return c, true
+	}
+	if i := strings.LastIndex(mediaType, "+"); i >= 0 {
+		c, ok := r.codecs["application/"+mediaType[i+1:]]
+		return c, ok
+	}
+	return nil, false
+}
+
+// Negotiate - picks codec for Accept header value, respecting q-values
+// and wildcards. Empty header accepts JSON.
+func (r *Registry) Negotiate(accept string) (string, Codec, bool) {
+	if strings.TrimSpace(accept) == "" {
+		accept = MediaTypeJSON
+	}
+	return r.NegotiateFor(accept, "")
+}
+
+// NegotiateFor - like Negotiate, but wildcards matching contentType pick it
+// if it is supported, e.g. to respond in the same type as request.
+// Empty header accepts anything.
+func (r *Registry) NegotiateFor(accept, contentType string) (string, Codec, bool) {
+	if strings.TrimSpace(accept) == "" {
+		accept = "*/*"
+	}
+	preferred := MediaType(contentType)
+	for _, ar := range parseAccept(accept) {
+		if ar.q <= 0 {
+			continue
+		}
+		if preferred != "" && matches(ar.mediaType, preferred) {
+			if c, ok := r.Get(preferred); ok {
+				return preferred, c, true
+			}
+		}
+		if mediaType, c, ok := r.match(ar.mediaType); ok {
+			return mediaType, c, true
+		}
+	}
+	return "", nil, false
+}
+
+func (r *Registry) match(mediaRange string) (string, Codec, bool) {
+	if mediaRange == "*/*" {
+		mediaRange = MediaTypeJSON
+	}
+	if strings.HasSuffix(mediaRange, "/*") {
+		prefix := strings.TrimSuffix(mediaRange, "*")
+		r.m.RLock()
+		defer r.m.RUnlock()
+		for _, mediaType := range r.order {
+			if strings.HasPrefix(mediaType, prefix) {
+				return mediaType, r.codecs[mediaType], true
+			}
+		}
+		return "", nil, false
+	}
+	c, ok := r.Get(mediaRange)
+	return mediaRange, c, ok
+}
+
+func matches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	return strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+}
+
+// MediaType - lower cased media type without parameters
+func MediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	}
+	return strings.ToLower(mediaType)
+}
+
+// sorted by q-value, more specific ranges first for equal q
+func parseAccept(accept string) []acceptRange {
+	ranges := make([]acceptRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+		return wildcards(ranges[i].mediaType) < wildcards(ranges[j].mediaType)
+	})
+	return ranges
+}
+
+func wildcards(mediaRange string) int {
+	return strings.Count(mediaRange, "*")
+}
+
+// MediaTypeFor - guesses media type for data without content type:
+// form for maps of strings, JSON for everything else
+func MediaTypeFor(v interface{}) string {
+	switch v.(type) {
+	case map[string]string, url.Values, *url.Values:
+		return MediaTypeForm
+	}
+	return MediaTypeJSON
+}
+
+// Decode - unmarshals data with codec, *[]byte and *string
+// targets receive raw body regardless of codec. map[string]string
+// can be passed by value to codecs that expect a pointer.
+func Decode(c Codec, data []byte, v interface{}) error {
+	switch out := v.(type) {
+	case nil:
+		return nil
+	case map[string]string:
+		if _, ok := c.(Form); ok {
+			break
+		}
+		decoded := make(map[string]string)
+		if err := c.Unmarshal(data, &decoded); err != nil {
+			return err
+		}
+		for k, v := range decoded {
+			out[k] = v
+		}
+		return nil
+	case *[]byte:
+		*out = data
+		return nil
+	case *string:
+		*out = string(data)
+		return nil
+	}
+	return c.Unmarshal(data, v)
+}
@@ -0,0 +1,111 @@
+package codec
+
+import (
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type csv struct{}
+
+func (csv) Marshal(v interface{}) ([]byte, error)      { return []byte("a,b"), nil }
+func (csv) Unmarshal(data []byte, v interface{}) error { return nil }
+
+func TestRegistry_Get(t *testing.T) {
+	r := NewRegistry()
+	c, ok := r.Get("application/json; charset=utf-8")
+	assert.True(t, ok, "Parameters should be ignored")
+	assert.Equal(t, JSON{}, c, "JSON codec expected")
+	c, _ = r.Get("Application/JSON")
+	assert.Equal(t, JSON{}, c, "Media type should be case insensitive")
+	c, _ = r.Get("application/problem+json")
+	assert.Equal(t, JSON{}, c, "+json suffix should use JSON codec")
+	c, _ = r.Get("text/xml")
+	assert.Equal(t, XML{}, c, "XML codec expected")
+	_, ok = r.Get("text/csv")
+	assert.False(t, ok, "Unknown media type")
+	_, ok = r.Get("")
+	assert.False(t, ok, "Empty content type")
+
+	r.Register("text/csv", csv{})
+	c, ok = r.Get("text/csv; header=present")
+	assert.True(t, ok, "Registered codec should be found")
+	assert.Equal(t, csv{}, c, "Registered codec should be found")
+}
+
+func TestRegistry_Negotiate(t *testing.T) {
+	r := NewRegistry()
+	mediaType, _, ok := r.Negotiate("")
+	assert.True(t, ok, "Empty accept should negotiate JSON")
+	assert.Equal(t, MediaTypeJSON, mediaType, "Empty accept should negotiate JSON")
+
+	mediaType, _, _ = r.Negotiate("text/csv, application/xml;q=0.9, application/json;q=0.8")
+	assert.Equal(t, MediaTypeXML, mediaType, "Highest q of supported types should win")
+	mediaType, _, _ = r.Negotiate("*/*;q=0.1, text/plain")
+	assert.Equal(t, MediaTypeText, mediaType, "Specific type should win with higher q")
+	mediaType, _, _ = r.Negotiate("*/*")
+	assert.Equal(t, MediaTypeJSON, mediaType, "Wildcard should negotiate JSON")
+	mediaType, _, _ = r.Negotiate("text/*")
+	assert.Equal(t, MediaTypeText, mediaType, "Type wildcard should match first registered subtype")
+	mediaType, _, _ = r.NegotiateFor("*/*", "application/xml; charset=utf-8")
+	assert.Equal(t, MediaTypeXML, mediaType, "Wildcard should pick content type")
+	mediaType, _, _ = r.NegotiateFor("application/*", "text/plain")
+	assert.Equal(t, MediaTypeJSON, mediaType, "Content type outside of range should be skipped")
+	mediaType, _, _ = r.NegotiateFor("", "text/csv")
+	assert.Equal(t, MediaTypeJSON, mediaType, "Unsupported content type should be skipped")
+	_, _, ok = r.Negotiate("text/csv, application/json;q=0")
+	assert.False(t, ok, "Nothing supported")
+}
+
+func TestBuiltin(t *testing.T) {
+	form := map[string]string{}
+	assert.Nil(t, Form{}.Unmarshal([]byte("a=1&a=2&b=3"), form), "Form should be decoded")
+	assert.Equal(t, map[string]string{"a": "1,2", "b": "3"}, form, "Multiple values should be joined")
+	values := url.Values{}
+	assert.Nil(t, Form{}.Unmarshal([]byte("a=1&a=2"), &values), "Form should be decoded into url.Values")
+	assert.Equal(t, []string{"1", "2"}, values["a"], "Values should be kept")
+	assert.NotNil(t, Form{}.Unmarshal([]byte("a=1"), &form), "Map pointer is not supported")
+	data, _ := Form{}.Marshal(map[string]string{"name": "koala"})
+	assert.Equal(t, "name=koala", string(data), "Form should be encoded")
+
+	type koala struct {
+		XMLName xml.Name `xml:"koala"`
+		Name    string   `xml:"name"`
+	}
+	data, _ = XML{}.Marshal(koala{Name: "Bob"})
+	assert.Equal(t, "<koala><name>Bob</name></koala>", string(data), "XML should be encoded")
+
+	var raw []byte
+	assert.Nil(t, Decode(XML{}, []byte("<x/>"), &raw), "Raw body should be returned")
+	assert.Equal(t, "<x/>", string(raw), "Raw body should be returned")
+	var str string
+	assert.Nil(t, Decode(JSON{}, []byte(`{"a":1}`), &str), "Raw body should be returned")
+	assert.Equal(t, `{"a":1}`, str, "Raw body should be returned")
+
+}
+
+func TestProtoJSON(t *testing.T) {
+	c, ok := Get(MediaTypeProtoJSON)
+	assert.True(t, ok, "ProtoJSON should be registered")
+
+	ts := timestamppb.New(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	data, err := c.Marshal(ts)
+	assert.Nil(t, err, "Proto message should be encoded")
+	assert.Equal(t, `"2020-01-02T03:04:05Z"`, string(data), "Well known types should use JSON mapping")
+
+	var decoded timestamppb.Timestamp
+	assert.Nil(t, c.Unmarshal(data, &decoded), "Proto message should be decoded")
+	assert.Equal(t, ts.AsTime(), decoded.AsTime(), "Timestamp should be kept")
+
+	var s structpb.Struct
+	assert.Nil(t, c.Unmarshal([]byte(`{"name":"koala","age":3}`), &s), "Struct should be decoded")
+	assert.Equal(t, "koala", s.Fields["name"].GetStringValue(), "Field should be decoded")
+
+	_, err = c.Marshal(struct{}{})
+	assert.Error(t, err, "Non proto values should be rejected")
+	assert.Error(t, c.Unmarshal([]byte("{}"), &map[string]string{}), "Non proto targets should be rejected")
+}
@@ -0,0 +1,36 @@
+// Package forward - headers carried in context from incoming request to outgoing calls.
+// Stored by middleware.ForwardHeaders, sent by rest/client.
+package forward
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey string
+
+const headersKey = contextKey("forwardedHeaders")
+
+// WithHeaders - adds headers to be forwarded to ctx, merging with already present ones.
+// Useful when work doesn't start with http request, e.g. in queue consumers.
+func WithHeaders(ctx context.Context, h http.Header) context.Context {
+	merged := Headers(ctx)
+	for k, v := range h {
+		merged[http.CanonicalHeaderKey(k)] = v
+	}
+	return context.WithValue(ctx, headersKey, merged)
+}
+
+// Headers - returns copy of headers stored in ctx, never nil
+func Headers(ctx context.Context) http.Header {
+	h := http.Header{}
+	if ctx == nil {
+		return h
+	}
+	if stored, ok := ctx.Value(headersKey).(http.Header); ok {
+		for k, v := range stored {
+			h[k] = append([]string(nil), v...)
+		}
+	}
+	return h
+}
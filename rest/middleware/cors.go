@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	CORSOptions struct {
+		// "*" allows any origin, but not with AllowCredentials. CORS is disabled if empty
+		AllowedOrigins []string `env:"CORS_ALLOWED_ORIGINS" env-delim:"," long:"cors-allowed-origin"`
+		// GET, HEAD, POST, PUT, PATCH and DELETE by default
+		AllowedMethods []string `env:"CORS_ALLOWED_METHODS" env-delim:"," long:"cors-allowed-method"`
+		// headers requested in preflight are allowed if empty
+		AllowedHeaders   []string      `env:"CORS_ALLOWED_HEADERS" env-delim:"," long:"cors-allowed-header"`
+		ExposedHeaders   []string      `env:"CORS_EXPOSED_HEADERS" env-delim:"," long:"cors-exposed-header"`
+		AllowCredentials bool          `env:"CORS_ALLOW_CREDENTIALS" long:"cors-allow-credentials"`
+		MaxAge           time.Duration `env:"CORS_MAX_AGE" long:"cors-max-age"`
+	}
+)
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// Validate - rejects "*" origin combined with credentials, which would let
+// any site make credentialed requests
+func (o CORSOptions) Validate() error {
+	if !o.AllowCredentials {
+		return nil
+	}
+	for _, origin := range o.AllowedOrigins {
+		if origin == "*" {
+			return errors.New("middleware.CORS: AllowCredentials can't be used with \"*\" origin, list allowed origins")
+		}
+	}
+	return nil
+}
+
+// CORS - adds CORS headers for allowed origins and answers preflight requests.
+// Requests from other origins are passed without CORS headers, preflights get 403.
+// Panics if options are invalid, see CORSOptions.Validate.
+func CORS(options CORSOptions) func(http.Handler) http.Handler {
+	if err := options.Validate(); err != nil {
+		panic(err)
+	}
+	if len(options.AllowedMethods) == 0 {
+		options.AllowedMethods = defaultCORSMethods
+	}
+	anyOrigin := false
+	origins := make(map[string]bool)
+	for _, o := range options.AllowedOrigins {
+		if o == "*" {
+			anyOrigin = true
+		}
+		origins[strings.ToLower(o)] = true
+	}
+	methods := strings.Join(options.AllowedMethods, ", ")
+	allowedHeaders := strings.Join(options.AllowedHeaders, ", ")
+	exposedHeaders := strings.Join(options.ExposedHeaders, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if !anyOrigin && !origins[strings.ToLower(origin)] {
+				if preflight {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if anyOrigin {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if options.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if !preflight {
+				if exposedHeaders != "" {
+					h.Set("Access-Control-Expose-Headers", exposedHeaders)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", methods)
+			if allowedHeaders != "" {
+				h.Set("Access-Control-Allow-Headers", allowedHeaders)
+			} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+			if options.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(options.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	chi "github.com/go-chi/chi/middleware"
+	"github.com/hop-city/common/logger"
+	"github.com/hop-city/common/readiness"
+	"net/http"
+	"time"
+)
+
+type (
+	DefaultOptions struct {
+		// request context deadline, 504 is sent if handler misses it - 60s by default, negative disables
+		Timeout time.Duration `env:"HTTP_TIMEOUT" long:"http-timeout"`
+		// requests processed at once, 0 - unlimited
+		MaxConcurrent int `env:"HTTP_MAX_CONCURRENT" long:"http-max-concurrent"`
+		// requests waiting for free slot, the rest gets 503 right away
+		Backlog int `env:"HTTP_BACKLOG" long:"http-backlog"`
+		// how long request can wait in backlog - 10s by default
+		BacklogTimeout time.Duration `env:"HTTP_BACKLOG_TIMEOUT" long:"http-backlog-timeout"`
+
+		CORS CORSOptions
+		// forwarded to rest/client calls - DefaultForwardHeaders if empty
+		ForwardHeaders []string `no-flag:"true"`
+	}
+)
+
+// Default - production stack, in order: request ID, real IP, logger, panic recovery,
+// liveness/readiness and ping endpoints, CORS, concurrency limit, timeout and header forwarding.
+// Health checks are answered before limits apply. RealIP trusts X-Forwarded-For and X-Real-IP,
+// so server should be reachable only through load balancer. Panics if CORS options are invalid.
+func Default(options DefaultOptions) func(http.Handler) http.Handler {
+	if options.Timeout == 0 {
+		options.Timeout = 60 * time.Second
+	}
+	if options.BacklogTimeout == 0 {
+		options.BacklogTimeout = 10 * time.Second
+	}
+
+	stack := []func(http.Handler) http.Handler{
+		RequestID,
+		chi.RealIP,
+		logger.Middleware,
+		Recover,
+		readiness.Middleware,
+		Ping,
+	}
+	if len(options.CORS.AllowedOrigins) > 0 {
+		stack = append(stack, CORS(options.CORS))
+	}
+	if options.MaxConcurrent > 0 {
+		stack = append(stack, chi.ThrottleBacklog(options.MaxConcurrent, options.Backlog, options.BacklogTimeout))
+	}
+	if options.Timeout > 0 {
+		stack = append(stack, chi.Timeout(options.Timeout))
+	}
+	stack = append(stack, ForwardHeaders(options.ForwardHeaders...))
+
+	return func(next http.Handler) http.Handler {
+		for i := len(stack) - 1; i >= 0; i-- {
+			next = stack[i](next)
+		}
+		return next
+	}
+}
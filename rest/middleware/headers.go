@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"github.com/hop-city/common/rest/forward"
+	"net/http"
+)
+
+// DefaultForwardHeaders - request ID, locale and tracing (B3, W3C trace context) headers
+var DefaultForwardHeaders = []string{
+	"X-Request-Id",
+	"X-Correlation-Id",
+	"Accept-Language",
+	"Traceparent",
+	"Tracestate",
+	"B3",
+	"X-B3-TraceId",
+	"X-B3-SpanId",
+	"X-B3-ParentSpanId",
+	"X-B3-Sampled",
+	"X-B3-Flags",
+}
+
+// ForwardHeaders - stores allowed incoming headers in request context,
+// rest/client.Fetch copies them to outgoing requests made with that context.
+// See forward.WithHeaders for adding headers outside of http handlers.
+// Without names DefaultForwardHeaders are used.
+func ForwardHeaders(names ...string) func(http.Handler) http.Handler {
+	if len(names) == 0 {
+		names = DefaultForwardHeaders
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := http.Header{}
+			for _, name := range names {
+				if values, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+					h[http.CanonicalHeaderKey(name)] = values
+				}
+			}
+			if len(h) > 0 {
+				r = r.WithContext(forward.WithHeaders(r.Context(), h))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
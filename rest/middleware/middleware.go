@@ -5,8 +5,6 @@ import (
 	"net/http"
 )
 
-// TODO(mb) add moving headers to ctx
-
 func Ping(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" && r.URL.Path == "/ping" {
@@ -1,11 +1,15 @@
 package middleware
 
 import (
+	"github.com/go-chi/chi"
+	"github.com/hop-city/common/readiness"
+	"github.com/hop-city/common/rest/forward"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestPing(t *testing.T) {
@@ -41,3 +45,173 @@ func TestPing_isTransparent(t *testing.T) {
 		"Invalid response, should see '%s', received %s", resString, str)
 	server.Close()
 }
+
+func TestForwardHeaders(t *testing.T) {
+	var forwarded http.Header
+	lastHandler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			forwarded = forward.Headers(r.Context())
+		})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("x-request-id", "koala-1")
+	req.Header.Set("traceparent", "00-trace-span-01")
+	req.Header.Set("authorization", "Bearer secret")
+	ForwardHeaders()(lastHandler).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "koala-1", forwarded.Get("X-Request-Id"), "Request ID should be forwarded")
+	assert.Equal(t, "00-trace-span-01", forwarded.Get("Traceparent"), "Trace context should be forwarded")
+	assert.Empty(t, forwarded.Get("Authorization"), "Headers out of allowlist should not be forwarded")
+
+	ForwardHeaders("authorization")(lastHandler).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "Bearer secret", forwarded.Get("Authorization"), "Custom allowlist should be used")
+	assert.Empty(t, forwarded.Get("X-Request-Id"), "Custom allowlist replaces defaults")
+}
+
+func TestRequestID(t *testing.T) {
+	var id string
+	var forwarded http.Header
+	lastHandler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id = RequestIDFrom(r.Context())
+			forwarded = forward.Headers(r.Context())
+		})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	RequestID(lastHandler).ServeHTTP(rec, req)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id, "UUIDv4 should be generated")
+	assert.Equal(t, id, rec.Header().Get("X-Request-Id"), "Request ID should be sent back")
+	assert.Equal(t, id, forwarded.Get("X-Request-Id"), "Request ID should be forwarded")
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("x-request-id", "koala-1")
+	RequestID(lastHandler).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "koala-1", id, "Incoming request ID should be used")
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("x-request-id", "koala 1")
+	RequestID(lastHandler).ServeHTTP(httptest.NewRecorder(), req)
+	assert.NotEqual(t, "koala 1", id, "Invalid request ID should be replaced")
+}
+
+func TestRecover(t *testing.T) {
+	lastHandler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			panic("koala")
+		})
+
+	rec := httptest.NewRecorder()
+	Recover(lastHandler).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "Panic should be turned into 500")
+	assert.Equal(t, "Internal Server Error", rec.Body.String())
+
+	assert.Panics(t, func() {
+		Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}, "ErrAbortHandler should be passed on")
+}
+
+func TestCORS(t *testing.T) {
+	called := false
+	lastHandler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+	handler := CORS(CORSOptions{
+		AllowedOrigins: []string{"https://hop.city"},
+		ExposedHeaders: []string{"X-Request-Id"},
+		MaxAge:         time.Minute,
+	})(lastHandler)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("origin", "https://hop.city")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.True(t, called, "Request should be passed on")
+	assert.Equal(t, "https://hop.city", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "X-Request-Id", rec.Header().Get("Access-Control-Expose-Headers"))
+
+	called = false
+	req = httptest.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("origin", "https://hop.city")
+	req.Header.Set("access-control-request-method", "PUT")
+	req.Header.Set("access-control-request-headers", "authorization")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.False(t, called, "Preflight should be answered by middleware")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Methods"), "PUT")
+	assert.Equal(t, "authorization", rec.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "60", rec.Header().Get("Access-Control-Max-Age"))
+
+	req.Header.Set("origin", "https://evil.example")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "Preflight from unknown origin should be rejected")
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORS_credentials(t *testing.T) {
+	options := CORSOptions{AllowedOrigins: []string{"https://hop.city", "*"}, AllowCredentials: true}
+	assert.Error(t, options.Validate(), "Any origin with credentials should be rejected")
+	assert.Panics(t, func() { CORS(options) }, "Invalid options should be rejected at construction")
+
+	handler := CORS(CORSOptions{AllowedOrigins: []string{"https://hop.city"}, AllowCredentials: true})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("origin", "https://hop.city")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "https://hop.city", rec.Header().Get("Access-Control-Allow-Origin"), "Listed origin should be allowed")
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+
+	req.Header.Set("origin", "https://evil.example")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"), "Credentials should not be allowed for other origins")
+}
+
+func TestDefault(t *testing.T) {
+	readiness.Set("middleware", true)
+	var id, ip string
+	var deadline bool
+	router := chi.NewRouter()
+	router.Use(Default(DefaultOptions{MaxConcurrent: 1, CORS: CORSOptions{AllowedOrigins: []string{"*"}}}))
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		id = RequestIDFrom(r.Context())
+		ip = r.RemoteAddr
+		_, deadline = r.Context().Deadline()
+		w.WriteHeader(http.StatusOK)
+	})
+	router.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("koala")
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("x-request-id", "koala-1")
+	req.Header.Set("x-forwarded-for", "10.1.2.3")
+	req.Header.Set("origin", "https://hop.city")
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "koala-1", id, "Request ID should be taken from header")
+	assert.Equal(t, "koala-1", res.Header.Get("X-Request-Id"))
+	assert.Equal(t, "10.1.2.3", ip, "Real IP should be extracted")
+	assert.True(t, deadline, "Request should have timeout")
+	assert.Equal(t, "*", res.Header.Get("Access-Control-Allow-Origin"), "CORS should be applied")
+
+	res, err = http.Get(server.URL + "/panic")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode, "Panic should be recovered")
+
+	res, err = http.Get(server.URL + "/liveness")
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, "OK", string(b), "Health checks should be served")
+	res, _ = http.Get(server.URL + "/ping")
+	b, _ = ioutil.ReadAll(res.Body)
+	assert.Equal(t, "pong", string(b))
+}
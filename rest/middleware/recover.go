@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/hop-city/common/rest/server"
+	"github.com/rs/zerolog"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recover - logs panics with request logger and responds with 500.
+// http.ErrAbortHandler is passed on, so server can abort the connection.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			log := zerolog.Ctx(r.Context())
+			log.Error().
+				Str("panic", fmt.Sprint(rec)).
+				Str("stack", string(debug.Stack())).
+				Msgf("Panic serving %s %s", r.Method, r.URL.Path)
+			err := server.Respond(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			if err != nil {
+				log.Error().Err(err).Msg("Error responding after panic")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
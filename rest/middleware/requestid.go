@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	chi "github.com/go-chi/chi/middleware"
+	"github.com/hop-city/common/rest/forward"
+	"net/http"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// incoming ids longer than that are replaced
+const maxRequestID = 128
+
+// RequestID - takes request ID from X-Request-Id header or generates UUIDv4.
+// ID is stored in request context where logger.Middleware and chi GetReqID find it,
+// sent back in response header and forwarded to rest/client calls.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newUUID()
+			// keeps ForwardHeaders in line with generated id
+			r.Header.Set(requestIDHeader, id)
+		}
+		ctx := context.WithValue(r.Context(), chi.RequestIDKey, id)
+		ctx = forward.WithHeaders(ctx, http.Header{requestIDHeader: {id}})
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFrom - request ID stored by RequestID, empty if missing
+func RequestIDFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	return chi.GetReqID(ctx)
+}
+
+// printable ASCII only, so id is safe to log and send further
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
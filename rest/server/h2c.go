@@ -0,0 +1,17 @@
+//go:build go1.24
+
+package server
+
+import (
+	"net/http"
+)
+
+// Serves HTTP/2 without TLS next to HTTP/1.1, see ServerOptions.H2C
+func enableH2C(server *http.Server) error {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server.Protocols = protocols
+	return nil
+}
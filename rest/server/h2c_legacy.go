@@ -0,0 +1,13 @@
+//go:build !go1.24
+
+package server
+
+import (
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// http.Protocols, used to serve HTTP/2 without TLS, was added in Go 1.24
+func enableH2C(server *http.Server) error {
+	return errors.New("Network.StartServer: H2C requires Go 1.24 or newer")
+}
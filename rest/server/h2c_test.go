@@ -0,0 +1,45 @@
+//go:build go1.24
+
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestStart_h2c(t *testing.T) {
+	ctx, cancel, r := setup()
+	defer cancel()
+	r.Get("/proto", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	s, err := Start(ctx, ServerOptions{Router: r, Port: "0", H2C: true})
+	assert.NoError(t, err, "h2c server should start")
+	if err != nil {
+		return
+	}
+	url := "http://" + s.Addr().String() + "/proto"
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := http.Client{Transport: &http.Transport{Protocols: protocols}}
+	resp, err := client.Get(url)
+	assert.NoError(t, err, "HTTP/2 client should connect without TLS")
+	if err == nil {
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, 2, resp.ProtoMajor, "HTTP/2 response expected")
+		assert.Equal(t, "HTTP/2.0", string(b), "Request should be served over HTTP/2")
+	}
+
+	resp, err = http.Get(url)
+	assert.NoError(t, err, "HTTP/1.1 client should still be served")
+	if err == nil {
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "HTTP/1.1", string(b))
+	}
+
+	cancel()
+	assert.NoError(t, <-s.Done(), "h2c server should shut down cleanly")
+}
@@ -1,14 +1,14 @@
 package server
 
 import (
-	"encoding/json"
+	"github.com/hop-city/common/rest/codec"
 	"github.com/pkg/errors"
 	"io/ioutil"
 	"net/http"
-	"net/url"
-	"strings"
 )
 
+// Parse - reads request body into expected using codec for request content type.
+// Without known content type form is assumed for maps of strings and JSON otherwise.
 func Parse(r *http.Request, expected interface{}) error {
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -18,21 +18,15 @@ func Parse(r *http.Request, expected interface{}) error {
 	if expected == nil {
 		return nil
 	}
-	if out, ok := expected.(*string); ok {
-		*out = string(data)
-	} else if out, ok := expected.(map[string]string); ok {
-		params, err := url.ParseQuery(string(data))
-		if err != nil {
-			return errors.Errorf("rest/server.Parse: error parsing urlencoded data - '%s'", data)
-		}
-		for k, v := range params {
-			out[k] = strings.Join(v, ",")
-		}
-	} else {
-		err := json.Unmarshal(data, expected)
-		if err != nil {
-			return errors.Errorf("rest/server.Parse: error unmarshalling JSON data - '%s'", data)
-		}
+	contentType := r.Header.Get("content-type")
+	c, ok := codec.Get(contentType)
+	if !ok {
+		contentType = codec.MediaTypeFor(expected)
+		c, _ = codec.Get(contentType)
+	}
+	err = codec.Decode(c, data, expected)
+	if err != nil {
+		return errors.Errorf("rest/server.Parse: error decoding %s data - '%s'", codec.MediaType(contentType), data)
 	}
 
 	return nil
@@ -1,3 +1,30 @@
 package server
 
-// TODO(mb) write parse test
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"name":"koala"}`))
+	r.Header.Set("content-type", "application/json; charset=utf-8")
+	out := map[string]string{}
+	assert.Nil(t, Parse(r, out), "JSON should be parsed by content type")
+	assert.Equal(t, "koala", out["name"], "JSON should be parsed by content type")
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader(`<koala><Name>Bob</Name></koala>`))
+	r.Header.Set("content-type", "application/xml")
+	user := struct{ Name string }{}
+	assert.Nil(t, Parse(r, &user), "XML should be parsed")
+	assert.Equal(t, "Bob", user.Name, "XML should be parsed")
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader("name=koala"))
+	out = map[string]string{}
+	assert.Nil(t, Parse(r, out), "Form should be guessed for map")
+	assert.Equal(t, "koala", out["name"], "Form should be guessed for map")
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader("not json"))
+	assert.NotNil(t, Parse(r, &user), "Invalid JSON should return error")
+}
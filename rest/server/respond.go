@@ -1,13 +1,34 @@
 package server
 
 import (
-	"encoding/json"
+	"github.com/hop-city/common/rest/codec"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"net/http"
 )
 
+// Respond - writes data as JSON, errors and strings as plain text
 func Respond(w http.ResponseWriter, status int, data interface{}) error {
+	return respond(w, codec.MediaTypeJSON, status, data)
+}
+
+// ErrNotAcceptable - none of media types allowed by request Accept header is supported
+var ErrNotAcceptable = errors.New("rest/server: none of accepted media types is supported")
+
+// RespondTo - like Respond, but data is encoded with codec picked from
+// request Accept header. Wildcards and missing Accept pick request content type
+// if it is supported, JSON otherwise. If Accept doesn't allow any supported
+// media type 406 is sent instead of data and ErrNotAcceptable is returned.
+func RespondTo(w http.ResponseWriter, r *http.Request, status int, data interface{}) error {
+	mediaType, _, ok := codec.NegotiateFor(r.Header.Get("accept"), r.Header.Get("content-type"))
+	if !ok {
+		_ = respond(w, codec.MediaTypeText, http.StatusNotAcceptable, ErrNotAcceptable)
+		return ErrNotAcceptable
+	}
+	return respond(w, mediaType, status, data)
+}
+
+func respond(w http.ResponseWriter, mediaType string, status int, data interface{}) error {
 	var err error
 	var body []byte
 
@@ -24,13 +45,14 @@ func Respond(w http.ResponseWriter, status int, data interface{}) error {
 		w.Header().Set("content-type", "application/json")
 		body = raw
 	} else {
-		body, err = json.Marshal(data)
+		c, _ := codec.Get(mediaType)
+		body, err = c.Marshal(data)
 		if err != nil {
 			err = errors.Wrap(err, "Error marshalling data")
 			w.Header().Set("content-type", "text/plain")
 			body = []byte("Marshalling error")
 		} else {
-			w.Header().Set("content-type", "application/json")
+			w.Header().Set("content-type", mediaType)
 		}
 	}
 
@@ -1,3 +1,76 @@
 package server
 
-// TODO(mb) write respond tests
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type koala struct {
+	Name string `json:"name" xml:"name"`
+}
+
+func TestRespond(t *testing.T) {
+	w := httptest.NewRecorder()
+	_ = Respond(w, http.StatusCreated, koala{Name: "Bob"})
+	assert.Equal(t, http.StatusCreated, w.Code, "Status should be set")
+	assert.Equal(t, "application/json", w.Header().Get("content-type"), "JSON expected")
+	assert.Equal(t, `{"name":"Bob"}`, w.Body.String(), "JSON expected")
+
+	w = httptest.NewRecorder()
+	_ = Respond(w, http.StatusBadRequest, errors.New("bad koala"))
+	assert.Equal(t, "text/plain", w.Header().Get("content-type"), "Errors should be plain text")
+	assert.Equal(t, "bad koala", w.Body.String(), "Error message expected")
+}
+
+func TestRespondTo(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("accept", "text/html, application/xml;q=0.9, */*;q=0.1")
+	w := httptest.NewRecorder()
+	_ = RespondTo(w, r, http.StatusOK, koala{Name: "Bob"})
+	assert.Equal(t, "application/xml", w.Header().Get("content-type"), "XML should be negotiated")
+	assert.Equal(t, `<koala><name>Bob</name></koala>`, w.Body.String(), "XML expected")
+
+	r = httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("content-type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	_ = RespondTo(w, r, http.StatusOK, map[string]string{"name": "Bob"})
+	assert.Equal(t, "name=Bob", w.Body.String(), "Request content type should be used without accept")
+
+	r = httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("accept", "*/*")
+	r.Header.Set("content-type", "application/xml; charset=utf-8")
+	w = httptest.NewRecorder()
+	_ = RespondTo(w, r, http.StatusOK, koala{Name: "Bob"})
+	assert.Equal(t, "application/xml", w.Header().Get("content-type"), "Wildcard should pick request content type")
+
+	r = httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("accept", "application/json, */*;q=0.1")
+	r.Header.Set("content-type", "application/xml")
+	w = httptest.NewRecorder()
+	_ = RespondTo(w, r, http.StatusOK, koala{Name: "Bob"})
+	assert.Equal(t, "application/json", w.Header().Get("content-type"), "Preferred type should win over request content type")
+
+	r = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	_ = RespondTo(w, r, http.StatusOK, koala{Name: "Bob"})
+	assert.Equal(t, "application/json", w.Header().Get("content-type"), "JSON should be used without accept and content type")
+}
+
+func TestRespondTo_NotAcceptable(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("accept", "text/csv")
+	w := httptest.NewRecorder()
+	err := RespondTo(w, r, http.StatusOK, koala{Name: "Bob"})
+	assert.Equal(t, ErrNotAcceptable, err, "Error should be returned")
+	assert.Equal(t, http.StatusNotAcceptable, w.Code, "406 should be sent when nothing matches")
+	assert.Equal(t, ErrNotAcceptable.Error(), w.Body.String(), "Reason should be sent")
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("accept", "application/json;q=0")
+	w = httptest.NewRecorder()
+	_ = RespondTo(w, r, http.StatusOK, koala{Name: "Bob"})
+	assert.Equal(t, http.StatusNotAcceptable, w.Code, "Excluded types should not be used")
+}
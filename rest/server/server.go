@@ -2,11 +2,14 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/go-chi/chi"
+	"github.com/hop-city/common/readiness"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
+	"net"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 )
 
@@ -14,10 +17,31 @@ type (
 	ServerOptions struct {
 		Router chi.Router
 		Port   string
+		// already bound listener, e.g. port 0 or unix socket - Port is ignored if set
+		Listener net.Listener
+		// serve HTTPS, optionally requiring client certificates
+		TLS *TLSOptions
+		// accept HTTP/2 without TLS (prior knowledge, no Upgrade from HTTP/1.1),
+		// HTTP/1.1 is still served on the same listener. Needs Go 1.24,
+		// Start returns error when built with older one
+		H2C bool
 
 		ReadHeaderTimeout time.Duration
-		WriteTimeout time.Duration
-		IdleTimeout time.Duration
+		WriteTimeout      time.Duration
+		IdleTimeout       time.Duration
+		// time given to in-flight requests on shutdown - 30s by default
+		DrainTimeout time.Duration
+		// time between flipping readiness and draining, lets load balancer
+		// deregister the instance. 0 by default, as without load balancer
+		// (local runs, jobs) there is nothing to wait for - behind one set it
+		// to its deregistration time, e.g. a few seconds in Kubernetes
+		PreStopDelay time.Duration
+	}
+
+	// Server - running server
+	Server struct {
+		listener net.Listener
+		done     chan error
 	}
 )
 
@@ -26,15 +50,18 @@ func CreateRouter() chi.Router {
 	return r
 }
 
-func Start(ctx context.Context, opt ServerOptions) {
+// Start - binds listener and serves in background, shuts server down gracefully when ctx is done.
+// Bind errors are returned right away.
+func Start(ctx context.Context, opt ServerOptions) (*Server, error) {
 	log := zerolog.Ctx(ctx)
 
-	if opt.Port == "" {
-		opt.Port = os.Getenv("PORT")
-	}
-	if opt.Port == "" {
-		opt.Port = "8080"
-		log.Info().Msg("Network.StartServer: server port not provided - using default 8080")
+	var tlsConfig *tls.Config
+	if opt.TLS != nil {
+		var err error
+		tlsConfig, err = newTLSConfig(ctx, *opt.TLS)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if opt.ReadHeaderTimeout == 0 {
@@ -46,34 +73,95 @@ func Start(ctx context.Context, opt ServerOptions) {
 	if opt.IdleTimeout == 0 {
 		opt.IdleTimeout = 120 * time.Second
 	}
+	if opt.DrainTimeout == 0 {
+		opt.DrainTimeout = 30 * time.Second
+	}
 
 	// server
+	var handler http.Handler = opt.Router
+	if tlsConfig != nil {
+		handler = withClientIdentity(handler)
+	}
 	server := http.Server{
-		Addr:              ":" + opt.Port,
-		Handler:           opt.Router,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
 		ReadHeaderTimeout: opt.ReadHeaderTimeout,
 		WriteTimeout:      opt.WriteTimeout,
 		IdleTimeout:       opt.IdleTimeout,
 	}
+	if opt.H2C {
+		if err := enableH2C(&server); err != nil {
+			return nil, err
+		}
+	}
 
-	// start server
-	go func() {
-		err := server.ListenAndServe()
+	listener := opt.Listener
+	if listener == nil {
+		if opt.Port == "" {
+			opt.Port = os.Getenv("PORT")
+		}
+		if opt.Port == "" {
+			opt.Port = "8080"
+			log.Info().Msg("Network.StartServer: server port not provided - using default 8080")
+		}
+		var err error
+		listener, err = net.Listen("tcp", ":"+opt.Port)
 		if err != nil {
-			if !strings.Contains(err.Error(), "Server closed") {
-				log.Error().Err(err).Msg("Network.StartServer: Error starting server")
-			}
+			return nil, errors.Wrap(err, "Network.StartServer: error starting server")
 		}
+	}
+
+	// start server - previous one could leave readiness flipped
+	readiness.Set(readiness.ShuttingDown, true)
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			// certificate comes from TLSConfig.GetCertificate
+			serveErr <- server.ServeTLS(listener, "", "")
+			return
+		}
+		serveErr <- server.Serve(listener)
 	}()
-	log.Info().Msgf("Network.StartServer: starting listening on port %s", opt.Port)
+	log.Info().Msgf("Network.StartServer: listening on %s", listener.Addr())
 
 	// stop server
+	s := &Server{listener: listener, done: make(chan error, 1)}
 	go func() {
-		<-ctx.Done()
-		err := server.Close()
+		defer close(s.done)
+		select {
+		case err := <-serveErr:
+			log.Error().Err(err).Msg("Network.StartServer: server stopped unexpectedly")
+			s.done <- err
+			return
+		case <-ctx.Done():
+		}
+
+		readiness.Set(readiness.ShuttingDown, false)
+		if opt.PreStopDelay > 0 {
+			log.Info().Msgf("Network.StartServer: waiting %s before shutdown", opt.PreStopDelay)
+			time.Sleep(opt.PreStopDelay)
+		}
+		drainCtx, cancel := context.WithTimeout(context.Background(), opt.DrainTimeout)
+		defer cancel()
+		err := server.Shutdown(drainCtx)
 		if err != nil {
-			log.Error().Err(err).Msg("Network.StartServer: error stopping server")
+			log.Error().Err(err).Msg("Network.StartServer: error draining connections, closing server")
+			_ = server.Close()
+			s.done <- err
+			return
 		}
 		log.Info().Msg("Network.StartServer: server shut down")
 	}()
+	return s, nil
+}
+
+// Addr - address server is bound to
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Done - closed once server is stopped, error is sent first
+// if server failed or could not drain connections
+func (s *Server) Done() <-chan error {
+	return s.done
 }
@@ -3,12 +3,17 @@ package server
 import (
 	"context"
 	"github.com/go-chi/chi"
+	"github.com/hop-city/common/readiness"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 )
 
 var lastReq *http.Request
@@ -31,9 +36,13 @@ func setup() (context.Context, func(), chi.Router) {
 func TestStart(t *testing.T) {
 	ctx, cancel, r := setup()
 	defer cancel()
-	Start(ctx, ServerOptions{r, "9019", 0, 0, 0})
+	s, err := Start(ctx, ServerOptions{Router: r, Port: "0"})
+	assert.NoError(t, err, "Server should start on random port")
+	if err != nil {
+		return
+	}
 
-	resp, err := http.Get("http://localhost:9019")
+	resp, err := http.Get("http://" + s.Addr().String())
 	assert.NoError(t, err, "We should be able to listen on custom port")
 	if err != nil {
 		return
@@ -46,7 +55,12 @@ func TestStartport(t *testing.T) {
 	ctx, cancel, r := setup()
 	defer cancel()
 
-	Start(ctx, ServerOptions{r, "", 0, 0, 0})
+	s, err := Start(ctx, ServerOptions{Router: r})
+	assert.NoError(t, err, "Server should start on default port")
+	if err != nil {
+		return
+	}
+	assert.Equal(t, 8080, s.Addr().(*net.TCPAddr).Port, "Default port expected")
 
 	resp, err := http.Get("http://localhost:8080")
 	assert.NoError(t, err, "We should be able to listen on default port")
@@ -55,4 +69,89 @@ func TestStartport(t *testing.T) {
 	}
 	b, _ := ioutil.ReadAll(resp.Body)
 	assert.Equal(t, "hello!", string(b), "Incorrect body returned")
+	cancel()
+	<-s.Done()
+}
+
+func TestStart_listener(t *testing.T) {
+	ctx, cancel, r := setup()
+	defer cancel()
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "server.sock")
+	l, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	if err != nil {
+		return
+	}
+
+	s, err := Start(ctx, ServerOptions{Router: r, Listener: l})
+	assert.NoError(t, err, "Server should start on provided listener")
+	assert.Equal(t, socket, s.Addr().String(), "Listener address expected")
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://unix/")
+	assert.NoError(t, err, "We should be able to call server over unix socket")
+	if err != nil {
+		return
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello!", string(b), "Incorrect body returned")
+}
+
+func TestStart_drain(t *testing.T) {
+	ctx, cancel, r := setup()
+	defer cancel()
+	started := make(chan struct{})
+	r.Get("/slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	}))
+	s, err := Start(ctx, ServerOptions{Router: r, Port: "0", PreStopDelay: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	if err != nil {
+		return
+	}
+
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + s.Addr().String() + "/slow")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		result <- string(b)
+	}()
+	<-started
+	cancel()
+
+	assert.Equal(t, "done", <-result, "In-flight request should be drained")
+	assert.NoError(t, <-s.Done(), "Server should shut down cleanly")
+	assert.False(t, readiness.IsReady(), "Readiness should flip on shutdown")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	_, err = Start(ctx, ServerOptions{Router: r, Port: "0"})
+	assert.NoError(t, err)
+	assert.True(t, readiness.IsReady(), "Readiness should be reset when server starts again")
+}
+
+func TestStart_error(t *testing.T) {
+	ctx, cancel, r := setup()
+	defer cancel()
+	s, err := Start(ctx, ServerOptions{Router: r, Port: "0"})
+	assert.NoError(t, err)
+	if err != nil {
+		return
+	}
+	port := strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+
+	_, err = Start(ctx, ServerOptions{Router: r, Port: port})
+	assert.Error(t, err, "Bind error should be returned")
 }
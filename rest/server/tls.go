@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type (
+	TLSOptions struct {
+		CertFile string
+		KeyFile  string
+		// PEM bundle of CAs signing client certificates, enables mutual TLS
+		ClientCAFile string
+		// accept clients without certificate, sent certificates are still verified
+		ClientCertOptional bool
+		// how often files are checked for changes - 10s by default
+		ReloadInterval time.Duration
+	}
+
+	// ClientIdentity - verified client certificate, see ClientIdentityFrom
+	ClientIdentity struct {
+		CommonName     string
+		Organization   []string
+		DNSNames       []string
+		EmailAddresses []string
+		URIs           []*url.URL
+		Certificate    *x509.Certificate
+	}
+
+	// keeps certificate and client CAs loaded from files, reloads them when files change
+	tlsFiles struct {
+		m        sync.RWMutex
+		options  TLSOptions
+		contents [][]byte
+		cert     *tls.Certificate
+		clientCA *x509.CertPool
+	}
+
+	clientIdentityKey struct{}
+)
+
+var tlsReloadInterval = 10 * time.Second
+
+// Builds TLS config serving current certificate,
+// files are polled until ctx is done
+func newTLSConfig(ctx context.Context, options TLSOptions) (*tls.Config, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, errors.New("Network.StartServer: Missing TLS certificate or key file")
+	}
+	if options.ReloadInterval <= 0 {
+		options.ReloadInterval = tlsReloadInterval
+	}
+	files := &tlsFiles{options: options}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+	go files.poll(ctx)
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: files.certificate,
+		// ServeTLS adds these to its own copy only, configs for
+		// clients are cloned from this one so they have to be set here
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if options.ClientCAFile != "" {
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := config.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = files.clientCAs()
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+			if options.ClientCertOptional {
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return c, nil
+		}
+	}
+	return config, nil
+}
+
+func (f *tlsFiles) read() ([][]byte, error) {
+	names := []string{f.options.CertFile, f.options.KeyFile, f.options.ClientCAFile}
+	contents := make([][]byte, len(names))
+	for i, name := range names {
+		if name == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Network.StartServer: error reading %s", name)
+		}
+		contents[i] = data
+	}
+	return contents, nil
+}
+
+// Loads files, keeps previous certificates if new ones are invalid
+func (f *tlsFiles) load() error {
+	contents, err := f.read()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		return errors.Wrap(err, "Network.StartServer: error loading TLS certificate")
+	}
+	var pool *x509.CertPool
+	if f.options.ClientCAFile != "" {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(contents[2]) {
+			return errors.Errorf("Network.StartServer: no certificates found in %s", f.options.ClientCAFile)
+		}
+	}
+	f.m.Lock()
+	f.contents = contents
+	f.cert = &cert
+	f.clientCA = pool
+	f.m.Unlock()
+	return nil
+}
+
+func (f *tlsFiles) changed() bool {
+	contents, err := f.read()
+	// file can be missing for a moment while being replaced
+	if err != nil {
+		return false
+	}
+	f.m.RLock()
+	defer f.m.RUnlock()
+	for i := range contents {
+		if !bytes.Equal(contents[i], f.contents[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *tlsFiles) poll(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(f.options.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !f.changed() {
+			continue
+		}
+		// cert and key are not replaced at once, mismatch is retried on next tick
+		if err := f.load(); err != nil {
+			log.Error().Err(err).Msg("Network.StartServer: error reloading TLS files")
+			continue
+		}
+		log.Info().Msg("Network.StartServer: TLS files reloaded")
+	}
+}
+
+func (f *tlsFiles) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return f.cert, nil
+}
+
+func (f *tlsFiles) clientCAs() *x509.CertPool {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return f.clientCA
+}
+
+// Adds verified client certificate identity to request context
+func withClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			cert := r.TLS.VerifiedChains[0][0]
+			id := &ClientIdentity{
+				CommonName:     cert.Subject.CommonName,
+				Organization:   cert.Subject.Organization,
+				DNSNames:       cert.DNSNames,
+				EmailAddresses: cert.EmailAddresses,
+				URIs:           cert.URIs,
+				Certificate:    cert,
+			}
+			r = r.WithContext(context.WithValue(r.Context(), clientIdentityKey{}, id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientIdentityFrom - identity of client verified with mutual TLS
+func ClientIdentityFrom(ctx context.Context) (*ClientIdentity, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	id, ok := ctx.Value(clientIdentityKey{}).(*ClientIdentity)
+	return id, ok
+}
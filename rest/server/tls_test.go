@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+var serial int64
+
+func newTestCert(t *testing.T, cn string, parent *testCert, client bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"hop-city"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	switch {
+	case parent == nil:
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	case client:
+		signer, signerKey = parent.cert, parent.key
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		signer, signerKey = parent.cert, parent.key
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func tlsClient(ca *testCert, cert *testCert) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: pool}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{cert.tls()}
+	}
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   config,
+		DisableKeepAlives: true,
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+func TestStart_tls(t *testing.T) {
+	ctx, cancel, r := setup()
+	defer cancel()
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil, false)
+	server := newTestCert(t, "server", ca, false)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	_ = ioutil.WriteFile(certFile, server.certPEM, 0600)
+	_ = ioutil.WriteFile(keyFile, server.keyPEM, 0600)
+
+	s, err := Start(ctx, ServerOptions{Router: r, Port: "0", TLS: &TLSOptions{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: 20 * time.Millisecond,
+	}})
+	assert.NoError(t, err, "TLS server should start")
+	if err != nil {
+		return
+	}
+	url := "https://127.0.0.1:" + strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+
+	resp, err := tlsClient(ca, nil).Get(url)
+	assert.NoError(t, err, "Client trusting CA should connect")
+	if err == nil {
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "hello!", string(b), "Incorrect body returned")
+		assert.Equal(t, "server", resp.TLS.PeerCertificates[0].Subject.CommonName)
+		assert.Equal(t, "HTTP/2.0", resp.Proto, "HTTP/2 should be negotiated")
+	}
+
+	rotated := newTestCert(t, "rotated", ca, false)
+	_ = ioutil.WriteFile(keyFile, rotated.keyPEM, 0600)
+	_ = ioutil.WriteFile(certFile, rotated.certPEM, 0600)
+	time.Sleep(100 * time.Millisecond)
+	resp, err = tlsClient(ca, nil).Get(url)
+	assert.NoError(t, err, "Client should connect after rotation")
+	if err == nil {
+		assert.Equal(t, "rotated", resp.TLS.PeerCertificates[0].Subject.CommonName, "Rotated certificate should be served")
+	}
+}
+
+func TestStart_mtls(t *testing.T) {
+	ctx, cancel, r := setup()
+	defer cancel()
+	var identity *ClientIdentity
+	r.Get("/whoami", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = ClientIdentityFrom(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil, false)
+	server := newTestCert(t, "server", ca, false)
+	client := newTestCert(t, "sibling", ca, true)
+	other := newTestCert(t, "other", newTestCert(t, "other-ca", nil, false), true)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	_ = ioutil.WriteFile(certFile, server.certPEM, 0600)
+	_ = ioutil.WriteFile(keyFile, server.keyPEM, 0600)
+	_ = ioutil.WriteFile(caFile, ca.certPEM, 0600)
+
+	s, err := Start(ctx, ServerOptions{Router: r, Port: "0", TLS: &TLSOptions{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+	}})
+	assert.NoError(t, err, "mTLS server should start")
+	if err != nil {
+		return
+	}
+	url := "https://127.0.0.1:" + strconv.Itoa(s.Addr().(*net.TCPAddr).Port) + "/whoami"
+
+	_, err = tlsClient(ca, nil).Get(url)
+	assert.Error(t, err, "Client without certificate should be rejected")
+	_, err = tlsClient(ca, other).Get(url)
+	assert.Error(t, err, "Client certificate from unknown CA should be rejected")
+
+	resp, err := tlsClient(ca, client).Get(url)
+	assert.NoError(t, err, "Client with valid certificate should connect")
+	if err == nil {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "HTTP/2.0", resp.Proto, "HTTP/2 should be negotiated with mTLS")
+		if assert.NotNil(t, identity, "Client identity should be in request context") {
+			assert.Equal(t, "sibling", identity.CommonName)
+			assert.Equal(t, []string{"sibling"}, identity.DNSNames)
+		}
+	}
+}
+
+func TestStart_tlsError(t *testing.T) {
+	ctx, cancel, r := setup()
+	defer cancel()
+	_, err := Start(ctx, ServerOptions{Router: r, Port: "0", TLS: &TLSOptions{CertFile: "missing.crt", KeyFile: "missing.key"}})
+	assert.Error(t, err, "Missing certificate should be reported")
+}